@@ -2,6 +2,9 @@ package main
 
 import (
   "sort"
+  "strconv"
+  "strings"
+  "time"
 )
 
 // function for sorting a slice of Songs
@@ -32,6 +35,7 @@ type Song struct {
   Md5 string
   EncodedSource string
   Sublibs string
+  Added time.Time
 }
 
 type Album struct {
@@ -47,3 +51,32 @@ type Artist struct {
   SortName string
   Albums map[string]*Album
 }
+
+// Convert a duration, which is either a number of seconds or of the form
+// [h:]m:ss, to seconds.  Returns zero if the duration can't be parsed.
+func durationSeconds(duration string) int {
+  seconds := 0.0
+  for _, part := range(strings.Split(strings.TrimSpace(duration), ":")) {
+    n, err := strconv.ParseFloat(part, 64)
+    if err != nil {
+      return 0
+    }
+    seconds = seconds * 60 + n
+  }
+  return int(seconds + 0.5)
+}
+
+// Returns the size part of a size and time key.
+func sizeFromSizeAndTime(sizeAndTime string) int64 {
+  size, _ := strconv.ParseInt(strings.SplitN(sizeAndTime, "-", 2)[0], 10, 64)
+  return size
+}
+
+// Splits s around the first instance of sep, like strings.Cut, which needs a
+// newer Go than go.mod allows.
+func cutString(s, sep string) (string, string, bool) {
+  if i := strings.Index(s, sep); i >= 0 {
+    return s[:i], s[i + len(sep):], true
+  }
+  return s, "", false
+}
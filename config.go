@@ -1,8 +1,7 @@
 package main
 
 import (
-  "crypto/md5"
-  "hash"
+  "fmt"
   "log"
   "io/ioutil"
   "github.com/urfave/cli/v2"
@@ -10,27 +9,102 @@ import (
   "github.com/brothertoad/btu"
 )
 
+const libraryFlag = "library"
+
+// Value of the library flag that selects every library.
+const allLibraries = "all"
+
+// Name of the library used when the configuration doesn't have a list of libraries.
+const defaultLibraryName = "default"
+
+// An encoder's commands are run for each song, with $INPUT and $OUTPUT
+// replaced by the paths of the song and the output.  An encoder without
+// commands copies songs that already have its extension.
 type EncoderInfo struct {
   Extension string `yaml:"extension"`
   Directory string `yaml:"dir"`
   IncludeOtherEncodings string `yaml:"includeOtherEncodings"`
   Commands []string `yaml:"commands"`
-  inputIndex int
-  outputIndex int
+  Tags bool `yaml:"tags"`
+  GainTags bool `yaml:"gainTags"`
+  backend Encoder
   includeOthers bool
 }
 
-// Configuration.
+// Settings for transcoding songs on the fly when serving them.  The commands
+// of the encoders must write to stdout, which they are told to do by $OUTPUT
+// being replaced with "-".  $BITRATE is replaced with the requested bitrate.
+type TranscodeInfo struct {
+  MaxConcurrent int `yaml:"maxConcurrent"`
+  CacheDir string `yaml:"cacheDir"`
+  DefaultBitrate int `yaml:"defaultBitrate"`
+  Encoders []EncoderInfo `yaml:"encoders"`
+}
+
+type SubsonicUser struct {
+  Name string `yaml:"name"`
+  Password string `yaml:"password"`
+}
+
+// Settings for the Subsonic API, which serve provides if it is enabled.
+type SubsonicInfo struct {
+  Enabled bool `yaml:"enabled"`
+  Users []SubsonicUser `yaml:"users"`
+}
+
+// A sub-library, which is a subset of the songs of a library that the sublib
+// command puts in a directory of its own.  A song is in the sublib if it is
+// listed in Songs (by its relative path) or is in one of the Playlists, or if
+// it matches every rule that is given.  Filter is a filter expression (see
+// sublibfilter.go), and each of the other rules is a list, which a song
+// matches if it matches any entry in the list.  The files are taken from
+// the music directory, or from the directory of the encoder with the
+// extension in Encoder, and are copied, or linked if Link is "hardlink" or
+// "symlink".
+type SublibInfo struct {
+  Name string `yaml:"name"`
+  Dir string `yaml:"dir"`
+  Encoder string `yaml:"encoder"`
+  Link string `yaml:"link"`
+  Artists []string `yaml:"artists"`
+  Albums []string `yaml:"albums"`
+  Extensions []string `yaml:"extensions"`
+  Flags []string `yaml:"flags"`
+  Songs []string `yaml:"songs"`
+  Playlists []string `yaml:"playlists"`
+  Filter string `yaml:"filter"`
+  filter sublibFilter
+}
+
+type LibraryInfo struct {
+  Name string `yaml:"name"`
+  MusicDir string `yaml:"musicDir"`
+  Encoders []EncoderInfo `yaml:"encoders"`
+  Sublibs []SublibInfo `yaml:"sublibs"`
+  Default bool `yaml:"default"`
+}
+
+// Configuration.  A configuration either has a list of libraries, or a
+// single music directory and lists of encoders and sublibs, which are
+// treated as a library named "default".
 var config struct {
   MusicDir string `yaml:"musicDir"`
   Mp3Dir string `yaml:"mp3Dir"`
   Encoders []EncoderInfo `yaml:"encoders"`
+  Sublibs []SublibInfo `yaml:"sublibs"`
+  Libraries []LibraryInfo `yaml:"libraries"`
+  Transcode TranscodeInfo `yaml:"transcode"`
+  Subsonic SubsonicInfo `yaml:"subsonic"`
+  ArtDir string `yaml:"artDir"`
   DbUrl string `yaml:"dbUrl"`
 }
 
 // Other global data.
-var musicDirLength int
-var hasher hash.Hash
+
+// The libraries selected by the library flag.
+var selectedLibraries []*LibraryInfo
+// The library currently being operated on.
+var library *LibraryInfo
 
 func Init(c *cli.Context) error {
   // Load the config file.
@@ -42,13 +116,80 @@ func Init(c *cli.Context) error {
   btu.CheckError(err)
   err = yaml.Unmarshal(b, &config)
   btu.CheckError(err)
-  // Verify our music directory is valid.
-  if len(config.MusicDir) == 0 {
-    log.Fatalln("No top level directory specified in configuration.")
-  }
-  btu.DirMustExist(config.MusicDir)
-  // Initialize the other global data.
-  musicDirLength = len(config.MusicDir)
-  hasher = md5.New()
+  if len(config.Libraries) == 0 {
+    config.Libraries = []LibraryInfo {
+      {Name: defaultLibraryName, MusicDir: config.MusicDir, Encoders: config.Encoders, Sublibs: config.Sublibs, Default: true},
+    }
+  }
+  // Verify our music directories are valid.
+  for _, lib := range(config.Libraries) {
+    if len(lib.MusicDir) == 0 {
+      log.Fatalf("No top level directory specified for library '%s' in configuration.\n", lib.Name)
+    }
+    btu.DirMustExist(lib.MusicDir)
+  }
+  selectedLibraries, err = selectLibraries(c.String(libraryFlag))
+  if err != nil {
+    log.Fatalln(err)
+  }
+  library = selectedLibraries[0]
+  return nil
+}
+
+// Returns the libraries named by the library flag.  If no name was given,
+// this is the default library.
+func selectLibraries(name string) ([]*LibraryInfo, error) {
+  libs := make([]*LibraryInfo, 0, len(config.Libraries))
+  for i := range(config.Libraries) {
+    lib := &config.Libraries[i]
+    if name == allLibraries || name == lib.Name || (name == "" && lib.Default) {
+      libs = append(libs, lib)
+    }
+  }
+  // If there is only one library, it is the default, whether or not it says so.
+  if name == "" && len(libs) == 0 && len(config.Libraries) == 1 {
+    libs = append(libs, &config.Libraries[0])
+  }
+  if len(libs) == 0 {
+    if name == "" {
+      return nil, fmt.Errorf("no default library in configuration; use --%s to choose one", libraryFlag)
+    }
+    return nil, fmt.Errorf("no library named '%s' in configuration", name)
+  }
+  if name == "" && len(libs) > 1 {
+    return nil, fmt.Errorf("more than one default library in configuration")
+  }
+  return libs, nil
+}
+
+// Returns the names of the selected libraries.
+func selectedLibraryNames() []string {
+  names := make([]string, len(selectedLibraries))
+  for i, lib := range(selectedLibraries) {
+    names[i] = lib.Name
+  }
+  return names
+}
+
+// Returns the default library, or nil if there isn't one.
+func defaultLibrary() *LibraryInfo {
+  libs, err := selectLibraries("")
+  if err != nil {
+    return nil
+  }
+  return libs[0]
+}
+
+// Calls f once for each of the selected libraries, with library set to that library.
+func forEachLibrary(f func() error) error {
+  for _, lib := range(selectedLibraries) {
+    library = lib
+    if len(selectedLibraries) > 1 {
+      fmt.Printf("Library %s:\n", lib.Name)
+    }
+    if err := f(); err != nil {
+      return err
+    }
+  }
   return nil
 }
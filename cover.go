@@ -0,0 +1,256 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "fmt"
+  "image"
+  "image/jpeg"
+  _ "image/png"
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  audiotag "github.com/dhowden/tag"
+  "github.com/labstack/echo/v4"
+  "golang.org/x/image/draw"
+)
+
+// Album art is stored in config.ArtDir, in a file named by the sha256 hash of
+// the image, so albums with the same art share a file.  The hash is recorded
+// in the cover_hash column of albums, which is null if the album hasn't been
+// checked for art yet, and empty if it was checked and doesn't have any.
+// Thumbnails are made when they are first requested, and are stored next to
+// the image they were made from.
+
+// Names of image files that hold the art for the album in their directory,
+// in order of preference.
+var folderImageNames = []string {
+  "cover.jpg", "cover.jpeg", "cover.png", "folder.jpg", "folder.jpeg", "folder.png",
+  "front.jpg", "front.jpeg", "front.png", "album.jpg", "album.png",
+}
+
+const minCoverSize = 16
+const maxCoverSize = 1024
+
+// Find the art for the albums of the current library.  Only albums that
+// haven't been checked are looked at, unless all is true.
+func findAlbumCovers(db *sql.DB, all bool) error {
+  if config.ArtDir == "" {
+    return nil
+  }
+  if err := os.MkdirAll(config.ArtDir, 0775); err != nil {
+    return err
+  }
+  query := `select album.id, min(song.relative_path) from albums album join songs song on song.album = album.id
+    where album.library = $1 and (album.cover_hash is null or $2) group by album.id`
+  rows, err := db.Query(query, library.Name, all)
+  if err != nil {
+    return err
+  }
+  // Read all of the albums before updating any of them.
+  paths := make(map[int]string)
+  for rows.Next() {
+    var id int
+    var relativePath string
+    if err := rows.Scan(&id, &relativePath); err != nil {
+      rows.Close()
+      return err
+    }
+    paths[id] = relativePath
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil {
+    return err
+  }
+  found := 0
+  for id, relativePath := range(paths) {
+    hash, err := saveAlbumCover(path.Join(library.MusicDir, relativePath))
+    if err != nil {
+      return err
+    }
+    if hash != "" {
+      found++
+    }
+    if _, err := db.Exec("update albums set cover_hash = $1 where id = $2", hash, id); err != nil {
+      return err
+    }
+  }
+  if verbose || found > 0 {
+    fmt.Printf("Found art for %d of %d albums checked\n", found, len(paths))
+  }
+  return nil
+}
+
+// Find the art for the album a song belongs to, save it if we don't already
+// have it, and return its hash.  The art embedded in the song is preferred to
+// an image in the song's directory.  Returns an empty hash if there is no art.
+func saveAlbumCover(songPath string) (string, error) {
+  data := embeddedPicture(songPath)
+  if data == nil {
+    data = folderImage(filepath.Dir(songPath))
+  }
+  if data == nil {
+    return "", nil
+  }
+  // Make sure it really is an image we can make thumbnails from.
+  if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err != nil {
+    if verbose {
+      fmt.Printf("Ignoring art for '%s': %s\n", songPath, err.Error())
+    }
+    return "", nil
+  }
+  sum := sha256.Sum256(data)
+  hash := hex.EncodeToString(sum[:])
+  coverPath := filepath.Join(config.ArtDir, hash)
+  if _, err := os.Stat(coverPath); err == nil {
+    return hash, nil
+  }
+  if err := writeFileAtomically(coverPath, data); err != nil {
+    return "", err
+  }
+  return hash, nil
+}
+
+func embeddedPicture(songPath string) []byte {
+  f, err := os.Open(songPath)
+  if err != nil {
+    return nil
+  }
+  defer f.Close()
+  m, err := audiotag.ReadFrom(f)
+  if err != nil || m.Picture() == nil || len(m.Picture().Data) == 0 {
+    return nil
+  }
+  return m.Picture().Data
+}
+
+func folderImage(dir string) []byte {
+  entries, err := os.ReadDir(dir)
+  if err != nil {
+    return nil
+  }
+  names := make(map[string]string, len(entries))
+  for _, entry := range(entries) {
+    names[strings.ToLower(entry.Name())] = entry.Name()
+  }
+  for _, name := range(folderImageNames) {
+    if actual, present := names[name]; present {
+      data, err := os.ReadFile(filepath.Join(dir, actual))
+      if err == nil {
+        return data
+      }
+    }
+  }
+  return nil
+}
+
+// Write a file by writing a temporary file and renaming it, so that readers
+// never see a partial file.
+func writeFileAtomically(filePath string, data []byte) error {
+  f, err := os.CreateTemp(filepath.Dir(filePath), "tmp-*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(f.Name())
+  if _, err := f.Write(data); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Close(); err != nil {
+    return err
+  }
+  return os.Rename(f.Name(), filePath)
+}
+
+// Returns the path of the cover with the given hash, scaled to fit in a
+// square of the given size, making the thumbnail if necessary.  A size of
+// zero means the original image.
+func coverPath(hash string, size int) (string, error) {
+  original := filepath.Join(config.ArtDir, hash)
+  if size == 0 {
+    return original, nil
+  }
+  thumbnail := fmt.Sprintf("%s-%d.jpg", original, size)
+  if _, err := os.Stat(thumbnail); err == nil {
+    return thumbnail, nil
+  }
+  data, err := os.ReadFile(original)
+  if err != nil {
+    return "", err
+  }
+  src, _, err := image.Decode(bytes.NewReader(data))
+  if err != nil {
+    return "", err
+  }
+  bounds := src.Bounds()
+  width, height := bounds.Dx(), bounds.Dy()
+  // Don't make thumbnails larger than the original.
+  if width <= size && height <= size {
+    return original, nil
+  }
+  if width > height {
+    width, height = size, height * size / width
+  } else {
+    width, height = width * size / height, size
+  }
+  dst := image.NewRGBA(image.Rect(0, 0, width, height))
+  draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+  var buf bytes.Buffer
+  if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+    return "", err
+  }
+  if err := writeFileAtomically(thumbnail, buf.Bytes()); err != nil {
+    return "", err
+  }
+  return thumbnail, nil
+}
+
+// Send the art for an album.  A size outside of the sizes thumbnails are
+// made in is brought into range, as clients (Subsonic ones in particular)
+// often ask for bigger covers than that, and expect an image anyway.
+func sendAlbumCover(e *echo.Echo, c echo.Context, db *sql.DB, albumId int, sizeString string) error {
+  size := 0
+  if sizeString != "" {
+    var err error
+    size, err = strconv.Atoi(sizeString)
+    if err != nil {
+      return c.String(http.StatusBadRequest, "Size must be a number\n")
+    }
+    if size < minCoverSize {
+      size = minCoverSize
+    } else if size > maxCoverSize {
+      size = maxCoverSize
+    }
+  }
+  hash, err := loadAlbumCoverHash(db, albumId)
+  if err == sql.ErrNoRows || (err == nil && hash == "") || config.ArtDir == "" {
+    return c.String(http.StatusNotFound, "No cover for album\n")
+  }
+  if err != nil {
+    e.Logger.Errorf("Error loading cover of album %d: %s\n", albumId, err.Error())
+    return c.String(http.StatusInternalServerError, "Error loading cover\n")
+  }
+  filePath, err := coverPath(hash, size)
+  if err != nil {
+    e.Logger.Errorf("Error making %d cover for album %d: %s\n", size, albumId, err.Error())
+    return c.String(http.StatusInternalServerError, "Error loading cover\n")
+  }
+  // The content of a cover file never changes, so clients can cache it.
+  c.Response().Header().Set("Cache-Control", "max-age=86400")
+  return c.File(filePath)
+}
+
+func getAlbumCover(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  albumString := c.Param("albumId")
+  albumId, err := strconv.Atoi(albumString)
+  if err != nil {
+    e.Logger.Errorf("Can't convert albumId '%s' to a number\n", albumString)
+    return c.String(http.StatusBadRequest, "Can't convert albumId to a number\n")
+  }
+  return sendAlbumCover(e, c, db, albumId, c.QueryParam("size"))
+}
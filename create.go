@@ -2,6 +2,7 @@ package main
 
 import (
   "fmt"
+  "runtime"
   "sort"
   "github.com/urfave/cli/v2"
   "github.com/brothertoad/tags"
@@ -12,6 +13,7 @@ const loadFlag = "load"
 const statsFlag = "stats"
 const dryRunFlag = "dry-run"
 const csvFlag = "csv"
+const jobsFlag = "jobs"
 
 var createCommand = cli.Command {
   Name: "create",
@@ -23,13 +25,28 @@ var createCommand = cli.Command {
     &cli.StringFlag {Name: loadFlag},
     &cli.BoolFlag {Name: statsFlag},
     &cli.BoolFlag {Name: dryRunFlag, Aliases: []string{"n"}},
+    &cli.IntFlag {Name: jobsFlag, Aliases: []string{"j"}, Value: runtime.NumCPU(), Usage: "number of files to scan concurrently"},
   },
 }
 
 func doCreate(c *cli.Context) error {
+  // The files named by these flags hold the songs of a single library.
+  if len(selectedLibraries) > 1 {
+    for _, flag := range([]string{saveFlag, csvFlag, loadFlag}) {
+      if len(c.String(flag)) > 0 {
+        return fmt.Errorf("--%s can only be used with a single library", flag)
+      }
+    }
+  }
+  return forEachLibrary(func() error {
+    return createLibrary(c)
+  })
+}
+
+func createLibrary(c *cli.Context) error {
   verbose := c.Bool(verboseFlag)
   if verbose {
-    fmt.Printf("Creating database from directory %s...\n", config.MusicDir)
+    fmt.Printf("Creating database from directory %s...\n", library.MusicDir)
   }
   var songMaps tags.TagMapSlice
 
@@ -38,7 +55,7 @@ func doCreate(c *cli.Context) error {
   if len(c.String(loadFlag)) > 0 {
     songMaps = loadSongsFromYaml(c.String(loadFlag))
   } else {
-    songMaps = loadSongMapSliceFromMusicDir(true)
+    songMaps = loadSongMapSliceFromMusicDir(true, c.Int(jobsFlag), nil)
   }
   sort.Sort(songMaps)
 
@@ -60,6 +77,7 @@ func doCreate(c *cli.Context) error {
     db := getDbConnection()
     defer db.Close()
     addArtistMapToDb(db, songMapsToArtistMap(songMaps, stats))
+    return findAlbumCovers(db, false)
   }
   return nil
 }
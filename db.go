@@ -2,72 +2,151 @@ package main
 
 import (
   "database/sql"
+  "fmt"
   "log"
   "strconv"
+  "strings"
+  "time"
   _ "github.com/jackc/pgx/v4/stdlib"
   "github.com/brothertoad/btu"
   "github.com/brothertoad/tags"
 )
 
+// Returns a connection to the database, exiting if the schema is out of date.
 func getDbConnection() *sql.DB {
+  db := openDb()
+  checkSchemaVersion(db)
+  return db
+}
+
+// Returns a connection to the database without checking the schema.
+func openDb() *sql.DB {
   db, err := sql.Open("pgx", config.DbUrl)
   btu.CheckError(err)
   return db
 }
 
+// Maximum number of rows added by a single insert statement.  Postgres allows
+// at most 65535 parameters in a statement, and a song has 14 of them.
+const insertBatchSize = 1000
+
+// Add the artists, albums and songs in the map to the database, setting their
+// ids.  Rather than using one round trip per row, the rows are added in batches
+// of multi-row inserts, and the generated ids are matched to the rows using the
+// unique key that is returned with them.
 func addArtistMapToDb(db *sql.DB, m map[string]Artist) {
-  artistStmt, artistErr := db.Prepare("insert into artists(name, sort_name) values ($1, $2) returning id")
-  btu.CheckError(artistErr)
-  defer artistStmt.Close()
+  artistRows := make([][]interface{}, 0, len(m))
+  for _, artist := range(m) {
+    artistRows = append(artistRows, []interface{}{artist.Name, artist.SortName})
+  }
+  // Artists are shared between libraries, so an artist that another library
+  // already added gets the existing id.
+  insertRows(db, "artists(name, sort_name)", "on conflict (name) do update set name = excluded.name",
+    "id, name", artistRows, func(rows *sql.Rows) {
+      var id int
+      var name string
+      btu.CheckError(rows.Scan(&id, &name))
+      // Artists are stored by value, so we have to put the updated copy back in the map.
+      artist := m[name]
+      artist.Id = id
+      m[name] = artist
+    })
 
-  albumStmt, albumErr := db.Prepare("insert into albums(artist, title, sort_title) values ($1, $2, $3) returning id")
-  btu.CheckError(albumErr)
-  defer albumStmt.Close()
+  albums := make(map[string]*Album)
+  albumRows := make([][]interface{}, 0, len(m) * 2)
+  for _, artist := range(m) {
+    for _, album := range(artist.Albums) {
+      albums[albumKey(artist.Id, album.Title)] = album
+      albumRows = append(albumRows, []interface{}{library.Name, artist.Id, album.Title, album.SortTitle})
+    }
+  }
+  insertRows(db, "albums(library, artist, title, sort_title)", "", "id, artist, title", albumRows, func(rows *sql.Rows) {
+    var id, artistId int
+    var title string
+    btu.CheckError(rows.Scan(&id, &artistId, &title))
+    albums[albumKey(artistId, title)].Id = id
+  })
 
-  songStmt, songErr := db.Prepare(`insert into songs(album, title, track_number, disc_number, duration,
-    flags, relative_path, base_path, mime, extension, encoded_extension, is_encoded, md5, size_and_time)
-    values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning id`)
-  btu.CheckError(songErr)
-  defer songStmt.Close()
+  songs := make(map[string]*Song)
+  songRows := make([][]interface{}, 0, len(albums) * 12)
+  for _, album := range(albums) {
+    for _, song := range(album.Songs) {
+      songs[song.RelativePath] = song
+      songRows = append(songRows, []interface{}{album.Id, song.Title, song.TrackNumber, song.DiscNumber,
+        song.Duration, song.Flags, song.RelativePath, song.BasePath, song.Mime, song.Extension,
+        song.EncodedExtension, song.IsEncoded, song.Md5, song.SizeAndTime})
+    }
+  }
+  insertRows(db, `songs(album, title, track_number, disc_number, duration, flags, relative_path,
+    base_path, mime, extension, encoded_extension, is_encoded, md5, size_and_time)`, "", "id, relative_path",
+    songRows, func(rows *sql.Rows) {
+      var id int
+      var relativePath string
+      btu.CheckError(rows.Scan(&id, &relativePath))
+      songs[relativePath].Id = id
+    })
+}
 
-  for _, artist := range(m) {
-    var artistId int
-    err := artistStmt.QueryRow(artist.Name, artist.SortName).Scan(&artistId)
-    if err != nil {
-      log.Fatalf("addArtistMapToDb: Error inserting artist '%s', error is %s\n", artist.Name, err.Error())
+func albumKey(artistId int, title string) string {
+  return strconv.Itoa(artistId) + "/" + title
+}
+
+// Insert rows into the table, which is specified along with its column list,
+// e.g., "artists(name, sort_name)".  If conflict is not empty, it is the
+// on conflict clause of the insert.  The returning columns are passed to
+// the scan function one row at a time.
+func insertRows(db *sql.DB, table, conflict, returning string, rows [][]interface{}, scan func(*sql.Rows)) {
+  for start := 0; start < len(rows); start += insertBatchSize {
+    end := start + insertBatchSize
+    if end > len(rows) {
+      end = len(rows)
     }
-    artist.Id = artistId
-    for _, album := range(artist.Albums) {
-      var albumId int
-      err := albumStmt.QueryRow(artistId, album.Title, album.SortTitle).Scan(&albumId)
-      btu.CheckError(err)
-      album.Id = albumId
-      for _, song := range(album.Songs) {
-        var songId int
-        err := songStmt.QueryRow(albumId, song.Title, song.TrackNumber, song.DiscNumber, song.Duration,
-          song.Flags, song.RelativePath, song.BasePath, song.Mime, song.Extension, song.EncodedExtension,
-          song.IsEncoded, song.Md5, song.SizeAndTime).Scan(&songId)
-        if err != nil {
-          log.Fatalf("addArtistMapToDb: Error inserting song '%s', album '%s', artist '%s', error is %s\n", song.Title, album.Title, artist.Name, err.Error())
+    var query strings.Builder
+    query.WriteString("insert into " + table + " values ")
+    args := make([]interface{}, 0, (end - start) * len(rows[start]))
+    for n, row := range(rows[start:end]) {
+      if n > 0 {
+        query.WriteString(", ")
+      }
+      query.WriteString("(")
+      for k, value := range(row) {
+        if k > 0 {
+          query.WriteString(", ")
         }
-        song.Id = songId
+        args = append(args, value)
+        query.WriteString("$" + strconv.Itoa(len(args)))
       }
+      query.WriteString(")")
+    }
+    if conflict != "" {
+      query.WriteString(" " + conflict)
+    }
+    query.WriteString(" returning " + returning)
+    result, err := db.Query(query.String(), args...)
+    if err != nil {
+      log.Fatalf("addArtistMapToDb: Error inserting into %s, error is %s\n", table, err.Error())
+    }
+    for result.Next() {
+      scan(result)
     }
+    btu.CheckError(result.Err())
+    result.Close()
   }
 }
 
+// Read the artists, and the albums and songs of the current library.
 func readArtistMapFromDb(db *sql.DB) map[string]Artist {
   artistStmt, artistErr := db.Prepare("select id, name, sort_name from artists")
   btu.CheckError(artistErr)
   defer artistStmt.Close()
 
-  albumStmt, albumErr := db.Prepare("select id, title, sort_title from albums where artist = $1")
+  albumStmt, albumErr := db.Prepare("select id, title, sort_title from albums where artist = $1 and library = $2")
   btu.CheckError(albumErr)
   defer albumStmt.Close()
 
   songStmt, songErr := db.Prepare(`select id, title, track_number, disc_number, duration,
     flags, state, relative_path, base_path, mime, extension, encoded_extension,
-    is_encoded, md5, size_and_time, encoded_source, sublibs from songs where album = $1`)
+    is_encoded, md5, size_and_time, encoded_source, sublibs, added from songs where album = $1`)
   btu.CheckError(songErr)
   defer songStmt.Close()
 
@@ -87,7 +166,7 @@ func readArtistMapFromDb(db *sql.DB) map[string]Artist {
     artistMap[artist.Name] = artist
     totalArtists++
 
-    albumRows, albumErr := albumStmt.Query(artist.Id)
+    albumRows, albumErr := albumStmt.Query(artist.Id, library.Name)
     btu.CheckError(albumErr)
     for albumRows.Next() {
       album := new(Album)
@@ -104,7 +183,7 @@ func readArtistMapFromDb(db *sql.DB) map[string]Artist {
         err := songRows.Scan(&song.Id, &song.Title, &song.TrackNumber,
           &song.DiscNumber, &song.Duration, &song.Flags, &song.State, &song.RelativePath, &song.BasePath,
           &song.Mime, &song.Extension, &song.EncodedExtension, &song.IsEncoded,
-          &song.Md5, &song.SizeAndTime, &song.EncodedSource, &song.Sublibs)
+          &song.Md5, &song.SizeAndTime, &song.EncodedSource, &song.Sublibs, &song.Added)
         btu.CheckError(err)
         album.Songs = append(album.Songs, song)
         totalSongs++
@@ -114,14 +193,16 @@ func readArtistMapFromDb(db *sql.DB) map[string]Artist {
   return artistMap
 }
 
+// Read the songs of the current library.
 func readSongListFromDb(db *sql.DB) []Song {
   songs := make([]Song, 0, 5000)
   stmt, err := db.Prepare(`select id, title, track_number, disc_number, duration,
     flags, state, relative_path, base_path, mime, extension, encoded_extension,
-    is_encoded, md5, size_and_time, encoded_source, sublibs from songs`)
+    is_encoded, md5, size_and_time, encoded_source, sublibs from songs
+    where album in (select id from albums where library = $1)`)
   btu.CheckError(err)
   defer stmt.Close()
-  rows, err := stmt.Query()
+  rows, err := stmt.Query(library.Name)
   btu.CheckError(err)
   for rows.Next() {
     var song Song
@@ -135,128 +216,421 @@ func readSongListFromDb(db *sql.DB) []Song {
   return songs
 }
 
-func addSongsToDb(db *sql.DB, songMaps map[string]tags.TagMap) {
-  artistQueryStmt, artistQueryErr := db.Prepare("select id from artists where name = $1")
-  btu.CheckError(artistQueryErr)
-  defer artistQueryStmt.Close()
+// Prepared statements for finding the id of the album a song belongs to in
+// the current library, adding the artist and album if they don't exist yet.
+type albumStmts struct {
+  artistQuery *sql.Stmt
+  artistInsert *sql.Stmt
+  albumQuery *sql.Stmt
+  albumInsert *sql.Stmt
+}
 
-  artistInsertStmt, artistInsertErr := db.Prepare("insert into artists(name, sort_name) values ($1, $2) returning id")
-  btu.CheckError(artistInsertErr)
-  defer artistInsertStmt.Close()
+func prepareAlbumStmts(tx *sql.Tx) (albumStmts, error) {
+  var stmts albumStmts
+  var err error
+  if stmts.artistQuery, err = tx.Prepare("select id from artists where name = $1"); err != nil {
+    return stmts, err
+  }
+  if stmts.artistInsert, err = tx.Prepare("insert into artists(name, sort_name) values ($1, $2) returning id"); err != nil {
+    return stmts, err
+  }
+  if stmts.albumQuery, err = tx.Prepare("select id from albums where artist = $1 and title = $2 and library = $3"); err != nil {
+    return stmts, err
+  }
+  if stmts.albumInsert, err = tx.Prepare("insert into albums(artist, title, sort_title, library) values ($1, $2, $3, $4) returning id"); err != nil {
+    return stmts, err
+  }
+  return stmts, nil
+}
 
-  albumQueryStmt, albumQueryErr := db.Prepare("select id from albums where artist = $1 and title = $2")
-  btu.CheckError(albumQueryErr)
-  defer albumQueryStmt.Close()
+// Close the statements.  This is safe to call if prepareAlbumStmts failed part way through.
+func (stmts albumStmts) Close() {
+  for _, stmt := range([]*sql.Stmt{stmts.artistQuery, stmts.artistInsert, stmts.albumQuery, stmts.albumInsert}) {
+    if stmt != nil {
+      stmt.Close()
+    }
+  }
+}
 
-  albumInsertStmt, albumInsertErr := db.Prepare("insert into albums(artist, title, sort_title) values ($1, $2, $3) returning id")
-  btu.CheckError(albumInsertErr)
-  defer albumInsertStmt.Close()
+func (stmts albumStmts) getAlbumId(songMap tags.TagMap) (int, error) {
+  var artistId int
+  err := stmts.artistQuery.QueryRow(songMap[tags.ArtistKey]).Scan(&artistId)
+  if err == sql.ErrNoRows {
+    err = stmts.artistInsert.QueryRow(songMap[tags.ArtistKey], songMap[tags.ArtistSortKey]).Scan(&artistId)
+  }
+  if err != nil {
+    return 0, fmt.Errorf("error finding or adding artist '%s': %w", songMap[tags.ArtistKey], err)
+  }
+  var albumId int
+  err = stmts.albumQuery.QueryRow(artistId, songMap[tags.AlbumKey], library.Name).Scan(&albumId)
+  if err == sql.ErrNoRows {
+    err = stmts.albumInsert.QueryRow(artistId, songMap[tags.AlbumKey], songMap[tags.AlbumSortKey], library.Name).Scan(&albumId)
+  }
+  if err != nil {
+    return 0, fmt.Errorf("error finding or adding album '%s' by '%s': %w", songMap[tags.AlbumKey], songMap[tags.ArtistKey], err)
+  }
+  return albumId, nil
+}
 
-  songInsertStmt, songInsertErr := db.Prepare(`insert into songs(album, title, track_number, disc_number, duration,
+func addSongsToDb(tx *sql.Tx, songMaps map[string]tags.TagMap) error {
+  albumStmts, err := prepareAlbumStmts(tx)
+  defer albumStmts.Close()
+  if err != nil {
+    return err
+  }
+
+  songInsertStmt, err := tx.Prepare(`insert into songs(album, title, track_number, disc_number, duration,
     flags, relative_path, base_path, mime, extension, encoded_extension, is_encoded, md5, size_and_time)
     values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) returning id`)
-  btu.CheckError(songInsertErr)
+  if err != nil {
+    return err
+  }
   defer songInsertStmt.Close()
 
   // For each song, we need to check to see if the artist and album already
   // exist.  If not, we need to add them.
   for _, songMap := range(songMaps) {
-    var artistId int
-    err := artistQueryStmt.QueryRow(songMap[tags.ArtistKey]).Scan(&artistId)
-    if err != nil && err != sql.ErrNoRows {
-      btu.CheckError(err)
-    }
+    albumId, err := albumStmts.getAlbumId(songMap)
     if err != nil {
-      // err must be ErrNoRows, so the artist needs to be added.
-      err := artistInsertStmt.QueryRow(songMap[tags.ArtistKey], songMap[tags.ArtistSortKey]).Scan(&artistId)
-      btu.CheckError(err)
-    }
-    var albumId int
-    err = albumQueryStmt.QueryRow(artistId, songMap[tags.AlbumKey]).Scan(&albumId)
-    if err != nil && err != sql.ErrNoRows {
-      btu.CheckError(err)
-    }
-    if err != nil {
-      // err must be ErrNoRows, so the album needs to be added.
-      err := albumInsertStmt.QueryRow(artistId, songMap[tags.AlbumKey], songMap[tags.AlbumSortKey]).Scan(&albumId)
-      btu.CheckError(err)
+      return err
     }
     // Now we can add the song.
     var songId int
-    trackNumber := btu.Atoi(songMap[tags.TrackNumberKey])
-    discNumber := btu.Atoi(songMap[tags.DiscNumberKey])
+    trackNumber, discNumber, err := songNumbers(songMap)
+    if err != nil {
+      return err
+    }
     isEncoded, _ := strconv.ParseBool(songMap[tags.IsEncodedKey])
     err = songInsertStmt.QueryRow(albumId, songMap[tags.TitleKey], trackNumber, discNumber,
       songMap[tags.DurationKey], songMap[tags.FlagsKey], songMap[tags.RelativePathKey],
       songMap[tags.BasePathKey], songMap[tags.MimeKey], songMap[tags.ExtensionKey],
       songMap[tags.EncodedExtensionKey], isEncoded, songMap[tags.Md5Key], songMap[tags.SizeAndTimeKey]).Scan(&songId)
-    btu.CheckError(err)
+    if err != nil {
+      return fmt.Errorf("error adding song '%s': %w", songMap[tags.RelativePathKey], err)
+    }
   }
+  return nil
 }
 
-func updateSongEncodedSource(db *sql.DB, song Song) {
-  _, err := db.Exec("update songs set encoded_source = $1 where id = $2", song.EncodedSource, song.Id)
-  btu.CheckError(err)
+// Update songs whose tags have changed.  The song keeps its id and the columns
+// that aren't read from the file, such as state and sublibs, but it may be
+// moved to a different album (and artist).
+func updateSongsInDb(tx *sql.Tx, modified []songMove) error {
+  albumStmts, err := prepareAlbumStmts(tx)
+  defer albumStmts.Close()
+  if err != nil {
+    return err
+  }
+
+  songUpdateStmt, err := tx.Prepare(`update songs set album = $1, title = $2, track_number = $3,
+    disc_number = $4, duration = $5, mime = $6, extension = $7, encoded_extension = $8, is_encoded = $9,
+    md5 = $10, size_and_time = $11 where id = $12`)
+  if err != nil {
+    return err
+  }
+  defer songUpdateStmt.Close()
+
+  for _, move := range(modified) {
+    id, err := songMapId(move.stale)
+    if err != nil {
+      return err
+    }
+    songMap := move.fresh
+    albumId, err := albumStmts.getAlbumId(songMap)
+    if err != nil {
+      return err
+    }
+    trackNumber, discNumber, err := songNumbers(songMap)
+    if err != nil {
+      return err
+    }
+    isEncoded, _ := strconv.ParseBool(songMap[tags.IsEncodedKey])
+    _, err = songUpdateStmt.Exec(albumId, songMap[tags.TitleKey], trackNumber, discNumber,
+      songMap[tags.DurationKey], songMap[tags.MimeKey], songMap[tags.ExtensionKey],
+      songMap[tags.EncodedExtensionKey], isEncoded, songMap[tags.Md5Key], songMap[tags.SizeAndTimeKey], id)
+    if err != nil {
+      return fmt.Errorf("error updating song '%s': %w", songMap[tags.RelativePathKey], err)
+    }
+  }
+  return nil
 }
 
-func updateSongPaths(db *sql.DB, id int, songMap tags.TagMap) {
-  _, err := db.Exec("update songs set relative_path = $1, base_path = $2 where id = $3", songMap[tags.RelativePathKey], songMap[tags.BasePathKey], id)
-  btu.CheckError(err)
+// Returns the track and disc numbers of a song map.
+func songNumbers(songMap tags.TagMap) (int, int, error) {
+  trackNumber, err := strconv.Atoi(songMap[tags.TrackNumberKey])
+  if err != nil {
+    return 0, 0, fmt.Errorf("bad track number for '%s': %w", songMap[tags.RelativePathKey], err)
+  }
+  discNumber, err := strconv.Atoi(songMap[tags.DiscNumberKey])
+  if err != nil {
+    return 0, 0, fmt.Errorf("bad disc number for '%s': %w", songMap[tags.RelativePathKey], err)
+  }
+  return trackNumber, discNumber, nil
 }
 
-func deleteSongsFromDb(db *sql.DB, songMaps map[string]tags.TagMap) {
-  deleteStmt, deleteErr := db.Prepare("delete from songs where id = $1")
-  btu.CheckError(deleteErr)
-  defer deleteStmt.Close()
+// Returns the id of a song map read from the database.  The id is a string
+// in the map, so it has to be converted.
+func songMapId(songMap tags.TagMap) (int, error) {
+  id, err := strconv.Atoi(songMap[tags.IdKey])
+  if err != nil {
+    return 0, fmt.Errorf("can't convert '%s' to a song id: %w", songMap[tags.IdKey], err)
+  }
+  return id, nil
+}
 
-  for _, songMap := range(songMaps) {
-    // Have to convert the id value in the SongMap from a string to an int.
-    id := btu.Atoi(songMap[tags.IdKey])
-    _, err := deleteStmt.Exec(id)
-    btu.CheckError(err)
+// Returns the tags of each song of the current library, by song id.  The
+// track gain and peak of songs that have changed since they were analyzed
+// are left out.
+func readSongTagsFromDb(db *sql.DB) (map[int]songTags, error) {
+  tagsById := make(map[int]songTags)
+  rows, err := db.Query(`select song.id, song.title, artist.name, album.title, song.track_number,
+    song.disc_number, coalesce(album.cover_hash, ''),
+    case when song.loudness_source = song.size_and_time then song.track_gain end,
+    case when song.loudness_source = song.size_and_time then song.track_peak end,
+    album.album_gain, album.album_peak from songs song
+    join albums album on song.album = album.id join artists artist on album.artist = artist.id
+    where album.library = $1`, library.Name)
+  if err != nil {
+    return tagsById, err
   }
+  defer rows.Close()
+  for rows.Next() {
+    var songId int
+    var t songTags
+    err := rows.Scan(&songId, &t.Title, &t.Artist, &t.Album, &t.Track, &t.Disc, &t.CoverHash,
+      &t.TrackGain, &t.TrackPeak, &t.AlbumGain, &t.AlbumPeak)
+    if err != nil {
+      return tagsById, err
+    }
+    tagsById[songId] = t
+  }
+  return tagsById, rows.Err()
 }
 
-// Delete any albums that don't have any songs and artists that don't have any albums.
-func deleteEmptyContainers(db *sql.DB) {
-  deleteEmptyParents(db, "albums", "songs", "album")
-  deleteEmptyParents(db, "artists", "albums", "artist")
+// Returns the size and time of each song of the current library when each
+// encoder last encoded it, by song id and encoder extension.
+func readSongEncodings(db *sql.DB) (map[int]map[string]string, error) {
+  encodings := make(map[int]map[string]string)
+  rows, err := db.Query(`select encoding.song, encoding.encoder, encoding.source from song_encodings encoding
+    join songs song on encoding.song = song.id join albums album on song.album = album.id
+    where album.library = $1`, library.Name)
+  if err != nil {
+    return encodings, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var songId int
+    var encoder, source string
+    if err := rows.Scan(&songId, &encoder, &source); err != nil {
+      return encodings, err
+    }
+    if encodings[songId] == nil {
+      encodings[songId] = make(map[string]string)
+    }
+    encodings[songId][encoder] = source
+  }
+  return encodings, rows.Err()
 }
 
-func deleteEmptyParents(db *sql.DB, parentTable, childTable, keyCol string) {
-  parentQueryStmt, err := db.Prepare("select id from " + parentTable)
-  btu.CheckError(err)
-  defer parentQueryStmt.Close()
-  childQueryStmt, err := db.Prepare("select count(*) from " + childTable + " where " + keyCol + " = $1")
-  btu.CheckError(err)
-  defer childQueryStmt.Close();
+// Record that an encoder encoded a song when it had the given size and time.
+func recordSongEncoding(db *sql.DB, songId int, encoder, source string) error {
+  _, err := db.Exec(`insert into song_encodings(song, encoder, source) values ($1, $2, $3)
+    on conflict (song, encoder) do update set source = excluded.source, encoded = now()`, songId, encoder, source)
+  return err
+}
 
-  rows, err := parentQueryStmt.Query()
-  btu.CheckError(err)
-  idsToDelete := make([]int, 0)
+// Record that an encoder failed for a song, replacing any earlier failure.
+func recordEncodeFailure(db *sql.DB, songId int, encoder, message, stderr string) error {
+  _, err := db.Exec(`insert into encode_failures(song, encoder, error, stderr) values ($1, $2, $3, $4)
+    on conflict (song, encoder) do update set error = excluded.error, stderr = excluded.stderr, failed = now()`,
+    songId, encoder, message, stderr)
+  return err
+}
+
+func clearEncodeFailure(db *sql.DB, songId int, encoder string) error {
+  _, err := db.Exec("delete from encode_failures where song = $1 and encoder = $2", songId, encoder)
+  return err
+}
+
+// Returns the extensions of the encoders that failed for each song of the
+// current library, by song id.
+func readEncodeFailures(db *sql.DB) (map[int]map[string]bool, error) {
+  failures := make(map[int]map[string]bool)
+  rows, err := db.Query(`select failure.song, failure.encoder from encode_failures failure
+    join songs song on failure.song = song.id join albums album on song.album = album.id
+    where album.library = $1`, library.Name)
+  if err != nil {
+    return failures, err
+  }
+  defer rows.Close()
   for rows.Next() {
-    var id int
-    err = rows.Scan(&id)
-    btu.CheckError(err)
-    var count int
-    err = childQueryStmt.QueryRow(id).Scan(&count)
-    btu.CheckError(err)
-    if count == 0 {
-      idsToDelete = append(idsToDelete, id)
+    var songId int
+    var encoder string
+    if err := rows.Scan(&songId, &encoder); err != nil {
+      return failures, err
+    }
+    if failures[songId] == nil {
+      failures[songId] = make(map[string]bool)
     }
+    failures[songId][encoder] = true
   }
-  deleteIdsFromTable(db, idsToDelete, parentTable)
+  return failures, rows.Err()
 }
 
-func deleteIdsFromTable(db *sql.DB, ids []int, table string) {
-  if len(ids) == 0 {
-    return
+type encodeFailure struct {
+  RelativePath string
+  Encoder string
+  Error string
+  Stderr string
+  Failed time.Time
+}
+
+// Returns the failures of the current library, ordered by path.
+func readEncodeFailureList(db *sql.DB) ([]encodeFailure, error) {
+  failures := make([]encodeFailure, 0)
+  rows, err := db.Query(`select song.relative_path, failure.encoder, failure.error, failure.stderr, failure.failed
+    from encode_failures failure join songs song on failure.song = song.id join albums album on song.album = album.id
+    where album.library = $1 order by song.relative_path, failure.encoder`, library.Name)
+  if err != nil {
+    return failures, err
   }
-  stmt, err := db.Prepare("delete from " + table + " where id = $1")
-  btu.CheckError(err)
-  defer stmt.Close()
-  for _, id := range(ids) {
-    _, err := stmt.Exec(id)
-    btu.CheckError(err)
+  defer rows.Close()
+  for rows.Next() {
+    var failure encodeFailure
+    if err := rows.Scan(&failure.RelativePath, &failure.Encoder, &failure.Error, &failure.Stderr, &failure.Failed); err != nil {
+      return failures, err
+    }
+    failures = append(failures, failure)
+  }
+  return failures, rows.Err()
+}
+
+// Returns the size and time of each song of the current library when its
+// loudness was measured, by song id.  Songs that haven't been analyzed are
+// left out.
+func readLoudnessSources(db *sql.DB) (map[int]string, error) {
+  sources := make(map[int]string)
+  rows, err := db.Query(`select song.id, song.loudness_source from songs song join albums album on song.album = album.id
+    where album.library = $1 and song.loudness_source is not null`, library.Name)
+  if err != nil {
+    return sources, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var songId int
+    var source string
+    if err := rows.Scan(&songId, &source); err != nil {
+      return sources, err
+    }
+    sources[songId] = source
+  }
+  return sources, rows.Err()
+}
+
+func recordTrackLoudness(db *sql.DB, songId int, loudness, gain, peak float64, source string) error {
+  _, err := db.Exec(`update songs set track_loudness = $1, track_gain = $2, track_peak = $3, loudness_source = $4
+    where id = $5`, loudness, gain, peak, source, songId)
+  return err
+}
+
+// Returns the loudness of the songs of each album of the current library,
+// and the album's current gain and peak, by album id.
+func readAlbumLoudness(db *sql.DB) (map[int][]albumLoudnessEntry, map[int]albumGains, error) {
+  entries := make(map[int][]albumLoudnessEntry)
+  gains := make(map[int]albumGains)
+  rows, err := db.Query(`select album.id, song.duration, song.track_loudness, song.track_peak,
+    coalesce(song.loudness_source = song.size_and_time, false), album.album_gain, album.album_peak
+    from songs song join albums album on song.album = album.id where album.library = $1`, library.Name)
+  if err != nil {
+    return entries, gains, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var albumId int
+    var entry albumLoudnessEntry
+    var albumGain albumGains
+    err := rows.Scan(&albumId, &entry.Duration, &entry.Loudness, &entry.Peak, &entry.Current, &albumGain.Gain, &albumGain.Peak)
+    if err != nil {
+      return entries, gains, err
+    }
+    entries[albumId] = append(entries[albumId], entry)
+    gains[albumId] = albumGain
+  }
+  return entries, gains, rows.Err()
+}
+
+func updateAlbumGain(db *sql.DB, albumId int, gain, peak *float64) error {
+  _, err := db.Exec("update albums set album_gain = $1, album_peak = $2 where id = $3", gain, peak, albumId)
+  return err
+}
+
+// Returns the ids of the songs of the given albums.
+func readAlbumSongIds(db *sql.DB, albumIds []int) ([]int, error) {
+  songIds := make([]int, 0)
+  rows, err := db.Query("select id from songs where album = any($1)", albumIds)
+  if err != nil {
+    return songIds, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var songId int
+    if err := rows.Scan(&songId); err != nil {
+      return songIds, err
+    }
+    songIds = append(songIds, songId)
+  }
+  return songIds, rows.Err()
+}
+
+func updateSongSublibs(tx *sql.Tx, id int, sublibs string) error {
+  _, err := tx.Exec("update songs set sublibs = $1 where id = $2", sublibs, id)
+  return err
+}
+
+func updateSongPaths(tx *sql.Tx, id int, songMap tags.TagMap) error {
+  _, err := tx.Exec("update songs set relative_path = $1, base_path = $2 where id = $3", songMap[tags.RelativePathKey], songMap[tags.BasePathKey], id)
+  if err != nil {
+    return fmt.Errorf("error updating paths of song %d: %w", id, err)
+  }
+  return nil
+}
+
+func deleteSongsFromDb(tx *sql.Tx, songMaps map[string]tags.TagMap) error {
+  deleteStmt, err := tx.Prepare("delete from songs where id = $1")
+  if err != nil {
+    return err
+  }
+  defer deleteStmt.Close()
+
+  for _, songMap := range(songMaps) {
+    id, err := songMapId(songMap)
+    if err != nil {
+      return err
+    }
+    if _, err := deleteStmt.Exec(id); err != nil {
+      return fmt.Errorf("error deleting song %d: %w", id, err)
+    }
+  }
+  return nil
+}
+
+// Delete any albums that don't have any songs and artists that don't have any
+// albums, returning the number of albums and artists deleted.
+func deleteEmptyContainers(tx *sql.Tx) (int, int, error) {
+  numAlbums, err := deleteEmptyParents(tx, "albums", "songs", "album")
+  if err != nil {
+    return 0, 0, err
+  }
+  numArtists, err := deleteEmptyParents(tx, "artists", "albums", "artist")
+  return numAlbums, numArtists, err
+}
+
+func deleteEmptyParents(tx *sql.Tx, parentTable, childTable, keyCol string) (int, error) {
+  result, err := tx.Exec("delete from " + parentTable + " where not exists (select 1 from " +
+    childTable + " where " + childTable + "." + keyCol + " = " + parentTable + ".id)")
+  if err != nil {
+    return 0, fmt.Errorf("error deleting empty %s: %w", parentTable, err)
   }
+  n, err := result.RowsAffected()
+  return int(n), err
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "github.com/jackc/pgconn"
+)
+
+// Playlists aren't part of a library, but like the rest of the REST service,
+// only the songs in the selected libraries are listed or can be added.
+
+var errPlaylistExists = errors.New("playlist already exists")
+var errUnknownSong = errors.New("unknown song")
+
+func loadPlaylists(db *sql.DB) ([]PlaylistModel, error) {
+  resp := make([]PlaylistModel, 0)
+  rows, err := db.Query(`select playlist.id, playlist.name, count(album.id) from playlists playlist
+    left join playlist_songs entry on entry.playlist = playlist.id
+    left join songs song on song.id = entry.song
+    left join albums album on album.id = song.album and album.library = any($1)
+    group by playlist.id order by upper(playlist.name)`, selectedLibraryNames())
+  if err != nil {
+    return resp, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var playlist PlaylistModel
+    if err := rows.Scan(&playlist.Id, &playlist.Name, &playlist.SongCount); err != nil {
+      return resp, err
+    }
+    resp = append(resp, playlist)
+  }
+  return resp, rows.Err()
+}
+
+// Load a playlist with its songs, in order.
+func loadPlaylist(db *sql.DB, playlistId int) (PlaylistModel, error) {
+  var playlist PlaylistModel
+  playlist.Songs = make([]SongModel, 0)
+  err := db.QueryRow("select id, name from playlists where id = $1", playlistId).Scan(&playlist.Id, &playlist.Name)
+  if err != nil {
+    return playlist, err
+  }
+  rows, err := db.Query("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name, " + songGainColumns +
+    " from playlist_songs entry, songs song, albums album, artists artist where entry.playlist = $1" +
+    " and entry.song = song.id and song.album = album.id and album.artist = artist.id and album.library = any($2)" +
+    " order by entry.position", playlistId, selectedLibraryNames())
+  if err != nil {
+    return playlist, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var song SongModel
+    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title, &song.Album, &song.Artist,
+      &song.TrackGain, &song.TrackPeak, &song.AlbumGain, &song.AlbumPeak)
+    if err != nil {
+      return playlist, err
+    }
+    playlist.Songs = append(playlist.Songs, song)
+  }
+  playlist.SongCount = len(playlist.Songs)
+  return playlist, rows.Err()
+}
+
+func createPlaylist(db *sql.DB, name string, songIds []int) (int, error) {
+  tx, err := db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+  if err := checkPlaylistName(tx, name, 0); err != nil {
+    return 0, err
+  }
+  var playlistId int
+  if err := tx.QueryRow("insert into playlists(name) values ($1) returning id", name).Scan(&playlistId); err != nil {
+    return 0, playlistNameError(err)
+  }
+  if err := insertPlaylistSongs(tx, playlistId, 0, songIds); err != nil {
+    return 0, err
+  }
+  return playlistId, tx.Commit()
+}
+
+func renamePlaylist(db *sql.DB, playlistId int, name string) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+  if err := lockPlaylist(tx, playlistId); err != nil {
+    return err
+  }
+  if err := checkPlaylistName(tx, name, playlistId); err != nil {
+    return err
+  }
+  if _, err := tx.Exec("update playlists set name = $1 where id = $2", name, playlistId); err != nil {
+    return playlistNameError(err)
+  }
+  return tx.Commit()
+}
+
+// Add songs to the end of a playlist.
+func appendToPlaylist(db *sql.DB, playlistId int, songIds []int) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+  if err := lockPlaylist(tx, playlistId); err != nil {
+    return err
+  }
+  var last int
+  err = tx.QueryRow("select coalesce(max(position), 0) from playlist_songs where playlist = $1", playlistId).Scan(&last)
+  if err != nil {
+    return err
+  }
+  if err := insertPlaylistSongs(tx, playlistId, last, songIds); err != nil {
+    return err
+  }
+  return tx.Commit()
+}
+
+// Replace the songs of a playlist, which is how songs are reordered or
+// removed.  Only the songs in the selected libraries are replaced, as they
+// are the only ones the client can see.  The songs of other libraries are
+// kept, ahead of the new songs.
+func setPlaylistSongs(db *sql.DB, playlistId int, songIds []int) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+  if err := lockPlaylist(tx, playlistId); err != nil {
+    return err
+  }
+  _, err = tx.Exec(`delete from playlist_songs entry using songs song, albums album
+    where entry.playlist = $1 and entry.song = song.id and song.album = album.id and album.library = any($2)`,
+    playlistId, selectedLibraryNames())
+  if err != nil {
+    return err
+  }
+  var last int
+  err = tx.QueryRow("select coalesce(max(position), 0) from playlist_songs where playlist = $1", playlistId).Scan(&last)
+  if err != nil {
+    return err
+  }
+  if err := insertPlaylistSongs(tx, playlistId, last, songIds); err != nil {
+    return err
+  }
+  return tx.Commit()
+}
+
+func deletePlaylist(db *sql.DB, playlistId int) error {
+  result, err := db.Exec("delete from playlists where id = $1", playlistId)
+  if err != nil {
+    return err
+  }
+  if n, _ := result.RowsAffected(); n == 0 {
+    return sql.ErrNoRows
+  }
+  return nil
+}
+
+// Lock a playlist until the end of the transaction, so that concurrent
+// changes to it don't use the same positions.  Returns sql.ErrNoRows if
+// there is no such playlist.
+func lockPlaylist(tx *sql.Tx, playlistId int) error {
+  var id int
+  return tx.QueryRow("select id from playlists where id = $1 for update", playlistId).Scan(&id)
+}
+
+// Returns errPlaylistExists if a playlist other than playlistId has the name.
+func checkPlaylistName(tx *sql.Tx, name string, playlistId int) error {
+  var exists bool
+  err := tx.QueryRow("select exists (select * from playlists where name = $1 and id <> $2)", name, playlistId).Scan(&exists)
+  if err == nil && exists {
+    return errPlaylistExists
+  }
+  return err
+}
+
+// Returns errPlaylistExists for a violation of the unique constraint on the
+// names of playlists, which a concurrent create or rename can cause after
+// checkPlaylistName has passed.
+func playlistNameError(err error) error {
+  var pgErr *pgconn.PgError
+  if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+    return errPlaylistExists
+  }
+  return err
+}
+
+// Insert songs into a playlist after the given position.  Returns
+// errUnknownSong if any of the songs isn't in the selected libraries.
+func insertPlaylistSongs(tx *sql.Tx, playlistId, after int, songIds []int) error {
+  if len(songIds) == 0 {
+    return nil
+  }
+  var found, wanted int
+  err := tx.QueryRow(`select count(*), cardinality(array(select distinct unnest($1::int[])))
+    from songs song join albums album on song.album = album.id
+    where song.id = any($1) and album.library = any($2)`, songIds, selectedLibraryNames()).Scan(&found, &wanted)
+  if err != nil {
+    return err
+  }
+  if found != wanted {
+    return errUnknownSong
+  }
+  _, err = tx.Exec(`insert into playlist_songs(playlist, position, song)
+    select $1, $2 + entry.n, entry.song from unnest($3::int[]) with ordinality as entry(song, n)`,
+    playlistId, after, songIds)
+  return err
+}
+
+// A song with what the playlist import and export commands need to find its
+// file or match it against an entry in a playlist file.
+type playlistSong struct {
+  Song
+  Album string
+  Artist string
+  Library string
+}
+
+const playlistSongColumns = `song.id, song.title, song.duration, song.relative_path, song.base_path,
+  song.extension, song.encoded_extension, song.is_encoded, song.sublibs, album.title, artist.name, album.library`
+
+func loadPlaylistSongs(db *sql.DB, query string, args ...interface{}) ([]playlistSong, error) {
+  songs := make([]playlistSong, 0)
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    return songs, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var song playlistSong
+    err := rows.Scan(&song.Id, &song.Title, &song.Duration, &song.RelativePath, &song.BasePath,
+      &song.Extension, &song.EncodedExtension, &song.IsEncoded, &song.Sublibs, &song.Album, &song.Artist, &song.Library)
+    if err != nil {
+      return songs, err
+    }
+    songs = append(songs, song)
+  }
+  return songs, rows.Err()
+}
+
+// Load every song in the selected libraries, in the order of their ids.
+func loadPlaylistCandidates(db *sql.DB) ([]playlistSong, error) {
+  return loadPlaylistSongs(db, "select " + playlistSongColumns +
+    " from songs song, albums album, artists artist where song.album = album.id and album.artist = artist.id" +
+    " and album.library = any($1) order by song.id", selectedLibraryNames())
+}
+
+// Load the songs of a playlist, in order.
+func loadPlaylistEntries(db *sql.DB, playlistId int) ([]playlistSong, error) {
+  return loadPlaylistSongs(db, "select " + playlistSongColumns +
+    " from playlist_songs entry, songs song, albums album, artists artist where entry.playlist = $1" +
+    " and entry.song = song.id and song.album = album.id and album.artist = artist.id and album.library = any($2)" +
+    " order by entry.position", playlistId, selectedLibraryNames())
+}
+
+// Returns the id of the playlist with the given name, or sql.ErrNoRows if
+// there isn't one.
+func loadPlaylistId(db *sql.DB, name string) (int, error) {
+  var playlistId int
+  err := db.QueryRow("select id from playlists where name = $1", name).Scan(&playlistId)
+  return playlistId, err
+}
+
+// Returns the ids of the songs in the playlist with the given name, which is
+// empty if there is no such playlist.
+func loadPlaylistSongIds(db *sql.DB, name string) ([]int, error) {
+  songIds := make([]int, 0)
+  rows, err := db.Query(`select entry.song from playlist_songs entry join playlists playlist on entry.playlist = playlist.id
+    where playlist.name = $1 order by entry.position`, name)
+  if err != nil {
+    return songIds, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var songId int
+    if err := rows.Scan(&songId); err != nil {
+      return songIds, err
+    }
+    songIds = append(songIds, songId)
+  }
+  return songIds, rows.Err()
+}
@@ -4,16 +4,24 @@ import (
   "database/sql"
 )
 
-func loadArtists(db *sql.DB, state int) ([]ArtistModel, error) {
+// Returns a condition that is true if the sublibs column includes the sublib
+// in the given parameter, or if the parameter is empty.
+func sublibCondition(column, param string) string {
+  return "(" + param + " = '' or " + param + " = any(string_to_array(" + column + ", ',')))"
+}
+
+func loadArtists(db *sql.DB, state int, sublib string) ([]ArtistModel, error) {
   resp := make([]ArtistModel, 0)
   var stmt *sql.Stmt
   var err error
   if state != 0 {
     stmt, err = db.Prepare("select id, name from artists where exists " +
-      "(select * from albums where albums.artist = artists.id and exists " +
-        "(select * from songs where songs.album = albums.id and state = $1)) order by sort_name")
+      "(select * from albums where albums.artist = artists.id and albums.library = any($1) and exists " +
+        "(select * from songs where songs.album = albums.id and state = $2 and " + sublibCondition("sublibs", "$3") + ")) order by sort_name")
   } else {
-    stmt, err = db.Prepare("select id, name from artists order by sort_name")
+    stmt, err = db.Prepare("select id, name from artists where exists " +
+      "(select * from albums where albums.artist = artists.id and albums.library = any($1) and exists " +
+        "(select * from songs where songs.album = albums.id and " + sublibCondition("sublibs", "$2") + ")) order by sort_name")
   }
   if err != nil {
     return resp, err
@@ -21,9 +29,9 @@ func loadArtists(db *sql.DB, state int) ([]ArtistModel, error) {
   defer stmt.Close()
   var rows *sql.Rows
   if state != 0 {
-    rows, err = stmt.Query(state)
+    rows, err = stmt.Query(selectedLibraryNames(), state, sublib)
   } else {
-    rows, err = stmt.Query()
+    rows, err = stmt.Query(selectedLibraryNames(), sublib)
   }
   if err != nil {
     return resp, err
@@ -39,15 +47,16 @@ func loadArtists(db *sql.DB, state int) ([]ArtistModel, error) {
   return resp, nil
 }
 
-func loadAlbums(db *sql.DB, artistId, state int) ([]AlbumModel, error) {
+func loadAlbums(db *sql.DB, artistId, state int, sublib string) ([]AlbumModel, error) {
   resp := make([]AlbumModel, 0)
   var stmt *sql.Stmt
   var err error
   if state != 0 {
-    stmt, err = db.Prepare("select id, title from albums where artist = $1 and exists " +
-        "(select * from songs where songs.album = albums.id and state = $2) order by sort_title")
+    stmt, err = db.Prepare("select id, title from albums where artist = $1 and library = any($2) and exists " +
+        "(select * from songs where songs.album = albums.id and state = $3 and " + sublibCondition("sublibs", "$4") + ") order by sort_title")
   } else {
-    stmt, err = db.Prepare("select id, title from albums where artist = $1 order by sort_title")
+    stmt, err = db.Prepare("select id, title from albums where artist = $1 and library = any($2) and exists " +
+        "(select * from songs where songs.album = albums.id and " + sublibCondition("sublibs", "$3") + ") order by sort_title")
   }
   if err != nil {
     return resp, err
@@ -55,9 +64,9 @@ func loadAlbums(db *sql.DB, artistId, state int) ([]AlbumModel, error) {
   defer stmt.Close()
   var rows *sql.Rows
   if state != 0 {
-    rows, err = stmt.Query(artistId, state)
+    rows, err = stmt.Query(artistId, selectedLibraryNames(), state, sublib)
   } else {
-    rows, err = stmt.Query(artistId)
+    rows, err = stmt.Query(artistId, selectedLibraryNames(), sublib)
   }
   if err != nil {
     return resp, err
@@ -73,14 +82,24 @@ func loadAlbums(db *sql.DB, artistId, state int) ([]AlbumModel, error) {
   return resp, nil
 }
 
-func loadSongs(db *sql.DB, albumId, state int) ([]SongModel, error) {
+// The gains and peaks of a song and its album, for SongModel.  Like the tags
+// that encoders write, the track gain and peak of a song that has changed
+// since it was analyzed are left out.
+const songGainColumns = "case when song.loudness_source = song.size_and_time then song.track_gain end," +
+  " case when song.loudness_source = song.size_and_time then song.track_peak end, album.album_gain, album.album_peak"
+
+func loadSongs(db *sql.DB, albumId, state int, sublib string) ([]SongModel, error) {
   resp := make([]SongModel, 0)
   var stmt *sql.Stmt
   var err error
   if state != 0 {
-    stmt, err = db.Prepare("select id, disc_number, track_number, title from songs where album = $1 and state = $2 order by disc_number, track_number")
+    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, " + songGainColumns +
+      " from songs song join albums album on song.album = album.id where song.album = $1 and song.state = $2 and " +
+      sublibCondition("song.sublibs", "$3") + " order by song.disc_number, song.track_number")
   } else {
-    stmt, err = db.Prepare("select id, disc_number, track_number, title from songs where album = $1 order by disc_number, track_number")
+    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, " + songGainColumns +
+      " from songs song join albums album on song.album = album.id where song.album = $1 and " +
+      sublibCondition("song.sublibs", "$2") + " order by song.disc_number, song.track_number")
   }
   if err != nil {
     return resp, err
@@ -88,16 +107,17 @@ func loadSongs(db *sql.DB, albumId, state int) ([]SongModel, error) {
   defer stmt.Close()
   var rows *sql.Rows
   if state != 0 {
-    rows, err = stmt.Query(albumId, state)
+    rows, err = stmt.Query(albumId, state, sublib)
   } else {
-    rows, err = stmt.Query(albumId)
+    rows, err = stmt.Query(albumId, sublib)
   }
   if err != nil {
     return resp, err
   }
   for rows.Next() {
     var song SongModel
-    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title)
+    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title,
+      &song.TrackGain, &song.TrackPeak, &song.AlbumGain, &song.AlbumPeak)
     if err != nil {
       return resp, err
     }
@@ -106,16 +126,16 @@ func loadSongs(db *sql.DB, albumId, state int) ([]SongModel, error) {
   return resp, nil
 }
 
-func loadAllSongs(db *sql.DB, state int) ([]SongModel, error) {
+func loadAllSongs(db *sql.DB, state int, sublib string) ([]SongModel, error) {
   resp := make([]SongModel, 0)
   var stmt *sql.Stmt
   var err error
   if state != 0 {
-    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name from songs song, albums album, artists artist where song.state = $1" +
-      " and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
+    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name, " + songGainColumns + " from songs song, albums album, artists artist where song.state = $1" +
+      " and album.library = any($2) and " + sublibCondition("song.sublibs", "$3") + " and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
   } else {
-    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name from songs song, albums album, artists artist where" +
-      " song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
+    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name, " + songGainColumns + " from songs song, albums album, artists artist where" +
+      " album.library = any($1) and " + sublibCondition("song.sublibs", "$2") + " and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
   }
   if err != nil {
     return resp, err
@@ -123,16 +143,17 @@ func loadAllSongs(db *sql.DB, state int) ([]SongModel, error) {
   defer stmt.Close()
   var rows *sql.Rows
   if state != 0 {
-    rows, err = stmt.Query(state)
+    rows, err = stmt.Query(state, selectedLibraryNames(), sublib)
   } else {
-    rows, err = stmt.Query()
+    rows, err = stmt.Query(selectedLibraryNames(), sublib)
   }
   if err != nil {
     return resp, err
   }
   for rows.Next() {
     var song SongModel
-    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title, &song.Album, &song.Artist)
+    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title, &song.Album, &song.Artist,
+      &song.TrackGain, &song.TrackPeak, &song.AlbumGain, &song.AlbumPeak)
     if err != nil {
       return resp, err
     }
@@ -141,16 +162,16 @@ func loadAllSongs(db *sql.DB, state int) ([]SongModel, error) {
   return resp, nil
 }
 
-func loadAllSongsByArtist(db *sql.DB, artistId, state int) ([]SongModel, error) {
+func loadAllSongsByArtist(db *sql.DB, artistId, state int, sublib string) ([]SongModel, error) {
   resp := make([]SongModel, 0)
   var stmt *sql.Stmt
   var err error
   if state != 0 {
-    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name from songs song, albums album, artists artist where song.state = $1" +
-      " and artist.id = $2 and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
+    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name, " + songGainColumns + " from songs song, albums album, artists artist where song.state = $1" +
+      " and artist.id = $2 and album.library = any($3) and " + sublibCondition("song.sublibs", "$4") + " and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
   } else {
-    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name from songs song, albums album, artists artist where" +
-      " artist.id = $1 and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
+    stmt, err = db.Prepare("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name, " + songGainColumns + " from songs song, albums album, artists artist where" +
+      " artist.id = $1 and album.library = any($2) and " + sublibCondition("song.sublibs", "$3") + " and song.album = album.id and album.artist = artist.id order by artist.sort_name, album.sort_title, song.disc_number, song.track_number")
   }
   if err != nil {
     return resp, err
@@ -158,16 +179,17 @@ func loadAllSongsByArtist(db *sql.DB, artistId, state int) ([]SongModel, error)
   defer stmt.Close()
   var rows *sql.Rows
   if state != 0 {
-    rows, err = stmt.Query(state, artistId)
+    rows, err = stmt.Query(state, artistId, selectedLibraryNames(), sublib)
   } else {
-    rows, err = stmt.Query(artistId)
+    rows, err = stmt.Query(artistId, selectedLibraryNames(), sublib)
   }
   if err != nil {
     return resp, err
   }
   for rows.Next() {
     var song SongModel
-    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title, &song.Album, &song.Artist)
+    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title, &song.Album, &song.Artist,
+      &song.TrackGain, &song.TrackPeak, &song.AlbumGain, &song.AlbumPeak)
     if err != nil {
       return resp, err
     }
@@ -176,6 +198,71 @@ func loadAllSongsByArtist(db *sql.DB, artistId, state int) ([]SongModel, error)
   return resp, nil
 }
 
+// Search the artists, albums and songs of the selected libraries.  Each list
+// is ranked by how well it matches the query, and limit and offset apply to
+// each list separately.  Songs match on their own title, as well as the title
+// of their album and the name of their artist.
+func loadSearchResults(db *sql.DB, query string, limit, offset int) (SearchModel, error) {
+  var resp SearchModel
+  resp.Artists = make([]ArtistModel, 0)
+  resp.Albums = make([]AlbumModel, 0)
+  resp.Songs = make([]SongModel, 0)
+  libraries := selectedLibraryNames()
+
+  rows, err := db.Query("select artist.id, artist.name from artists artist, websearch_to_tsquery('simple', $1) query" +
+    " where artist.search @@ query and exists (select * from albums where albums.artist = artist.id and albums.library = any($2))" +
+    " order by ts_rank(artist.search, query) desc, artist.sort_name limit $3 offset $4", query, libraries, limit, offset)
+  if err != nil {
+    return resp, err
+  }
+  for rows.Next() {
+    var artist ArtistModel
+    if err := rows.Scan(&artist.Id, &artist.Name); err != nil {
+      rows.Close()
+      return resp, err
+    }
+    resp.Artists = append(resp.Artists, artist)
+  }
+  rows.Close()
+
+  rows, err = db.Query("select album.id, album.title from albums album, websearch_to_tsquery('simple', $1) query" +
+    " where album.search @@ query and album.library = any($2)" +
+    " order by ts_rank(album.search, query) desc, album.sort_title limit $3 offset $4", query, libraries, limit, offset)
+  if err != nil {
+    return resp, err
+  }
+  for rows.Next() {
+    var album AlbumModel
+    if err := rows.Scan(&album.Id, &album.Title); err != nil {
+      rows.Close()
+      return resp, err
+    }
+    resp.Albums = append(resp.Albums, album)
+  }
+  rows.Close()
+
+  rows, err = db.Query("select song.id, song.disc_number, song.track_number, song.title, album.title, artist.name, " + songGainColumns +
+    " from songs song, albums album, artists artist, websearch_to_tsquery('simple', $1) query" +
+    " where song.album = album.id and album.artist = artist.id and album.library = any($2)" +
+    " and (song.search || album.search || artist.search) @@ query" +
+    " order by ts_rank(setweight(song.search, 'A') || setweight(album.search, 'B') || setweight(artist.search, 'B'), query) desc," +
+    " artist.sort_name, album.sort_title, song.disc_number, song.track_number limit $3 offset $4", query, libraries, limit, offset)
+  if err != nil {
+    return resp, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var song SongModel
+    err := rows.Scan(&song.Id, &song.DiscNum, &song.TrackNum, &song.Title, &song.Album, &song.Artist,
+      &song.TrackGain, &song.TrackPeak, &song.AlbumGain, &song.AlbumPeak)
+    if err != nil {
+      return resp, err
+    }
+    resp.Songs = append(resp.Songs, song)
+  }
+  return resp, nil
+}
+
 func loadSongStates(db *sql.DB, req *UpdateSongStatesModel) error {
   for _, songId := range(req.SongIds) {
     _, err := db.Exec("update songs set state = $1 where id = $2", req.State, songId)
@@ -185,3 +272,23 @@ func loadSongStates(db *sql.DB, req *UpdateSongStatesModel) error {
   }
   return nil
 }
+
+// Load the hash of the art for an album in the selected libraries.  The hash
+// is empty if the album doesn't have any art.
+func loadAlbumCoverHash(db *sql.DB, albumId int) (string, error) {
+  var hash string
+  err := db.QueryRow("select coalesce(cover_hash, '') from albums where id = $1 and library = any($2)",
+    albumId, selectedLibraryNames()).Scan(&hash)
+  return hash, err
+}
+
+// Load the song with the given id, along with the name of its library.
+func loadSongWithLibrary(db *sql.DB, songId int) (Song, string, error) {
+  var song Song
+  var libraryName string
+  err := db.QueryRow(`select song.id, song.title, song.relative_path, song.base_path, song.mime, song.extension,
+    song.encoded_extension, song.is_encoded, song.size_and_time, album.library from songs song, albums album
+    where song.id = $1 and song.album = album.id`, songId).Scan(&song.Id, &song.Title, &song.RelativePath,
+    &song.BasePath, &song.Mime, &song.Extension, &song.EncodedExtension, &song.IsEncoded, &song.SizeAndTime, &libraryName)
+  return song, libraryName, err
+}
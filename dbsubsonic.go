@@ -0,0 +1,218 @@
+package main
+
+import (
+  "database/sql"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+// Queries for the Subsonic API.  Like the rest of the REST service, they only
+// return albums (and the artists and songs of albums) in the selected libraries.
+
+// Either a *sql.Row or *sql.Rows.
+type rowScanner interface {
+  Scan(dest ...interface{}) error
+}
+
+const subsonicSongColumns = `song.id, song.title, song.track_number, song.disc_number, song.duration,
+  song.mime, song.extension, song.relative_path, song.size_and_time, album.id, album.title, artist.id, artist.name,
+  coalesce(album.cover_hash, '')`
+
+const subsonicSongTables = `songs song join albums album on song.album = album.id
+  join artists artist on album.artist = artist.id`
+
+const subsonicAlbumColumns = `album.id, album.title, artist.id, artist.name, count(song.id),
+  coalesce(string_agg(song.duration, ','), ''), coalesce(album.cover_hash, '')`
+
+const subsonicAlbumTables = `albums album join artists artist on album.artist = artist.id
+  left join songs song on song.album = album.id`
+
+func scanSubsonicSong(row rowScanner) (subsonicSong, error) {
+  var song subsonicSong
+  var id, albumId, artistId int
+  var duration, sizeAndTime, coverHash string
+  err := row.Scan(&id, &song.Title, &song.Track, &song.DiscNumber, &duration, &song.ContentType,
+    &song.Suffix, &song.Path, &sizeAndTime, &albumId, &song.Album, &artistId, &song.Artist, &coverHash)
+  song.Id = strconv.Itoa(id)
+  song.AlbumId = strconv.Itoa(albumId)
+  song.Parent = song.AlbumId
+  song.ArtistId = strconv.Itoa(artistId)
+  song.Duration = durationSeconds(duration)
+  song.Size = sizeFromSizeAndTime(sizeAndTime)
+  song.Suffix = strings.TrimPrefix(song.Suffix, ".")
+  song.Type = "music"
+  if coverHash != "" {
+    song.CoverArt = song.AlbumId
+  }
+  return song, err
+}
+
+func scanSubsonicAlbum(row rowScanner) (subsonicAlbum, error) {
+  var album subsonicAlbum
+  var id, artistId int
+  var durations, coverHash string
+  err := row.Scan(&id, &album.Name, &artistId, &album.Artist, &album.SongCount, &durations, &coverHash)
+  album.Id = strconv.Itoa(id)
+  album.ArtistId = strconv.Itoa(artistId)
+  for _, duration := range(strings.Split(durations, ",")) {
+    album.Duration += durationSeconds(duration)
+  }
+  if coverHash != "" {
+    album.CoverArt = album.Id
+  }
+  return album, err
+}
+
+func loadSubsonicSongs(db *sql.DB, query string, args ...interface{}) ([]subsonicSong, error) {
+  songs := make([]subsonicSong, 0)
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    return songs, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    song, err := scanSubsonicSong(rows)
+    if err != nil {
+      return songs, err
+    }
+    songs = append(songs, song)
+  }
+  return songs, rows.Err()
+}
+
+func loadSubsonicAlbums(db *sql.DB, query string, args ...interface{}) ([]subsonicAlbum, error) {
+  albums := make([]subsonicAlbum, 0)
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    return albums, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    album, err := scanSubsonicAlbum(rows)
+    if err != nil {
+      return albums, err
+    }
+    albums = append(albums, album)
+  }
+  return albums, rows.Err()
+}
+
+func loadSubsonicArtists(db *sql.DB, query string, args ...interface{}) ([]subsonicArtist, []string, error) {
+  artists := make([]subsonicArtist, 0)
+  sortNames := make([]string, 0)
+  rows, err := db.Query(query, args...)
+  if err != nil {
+    return artists, sortNames, err
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var artist subsonicArtist
+    var id int
+    var sortName string
+    if err := rows.Scan(&id, &artist.Name, &sortName, &artist.AlbumCount); err != nil {
+      return artists, sortNames, err
+    }
+    artist.Id = strconv.Itoa(id)
+    artists = append(artists, artist)
+    sortNames = append(sortNames, sortName)
+  }
+  return artists, sortNames, rows.Err()
+}
+
+// Load the artists, grouped by the first letter of their sort names.
+func loadSubsonicIndexes(db *sql.DB) ([]subsonicIndex, error) {
+  indexes := make([]subsonicIndex, 0)
+  artists, sortNames, err := loadSubsonicArtists(db, `select artist.id, artist.name, artist.sort_name, count(album.id)
+    from artists artist join albums album on album.artist = artist.id where album.library = any($1)
+    group by artist.id order by upper(artist.sort_name)`, selectedLibraryNames())
+  if err != nil {
+    return indexes, err
+  }
+  for i, artist := range(artists) {
+    name := "#"
+    if first := []rune(strings.ToUpper(sortNames[i])); len(first) > 0 && unicode.IsLetter(first[0]) {
+      name = string(first[0])
+    }
+    if len(indexes) == 0 || indexes[len(indexes) - 1].Name != name {
+      indexes = append(indexes, subsonicIndex{Name: name})
+    }
+    last := &indexes[len(indexes) - 1]
+    last.Artists = append(last.Artists, artist)
+  }
+  return indexes, nil
+}
+
+func loadSubsonicArtist(db *sql.DB, artistId int) (subsonicArtist, error) {
+  var artist subsonicArtist
+  err := db.QueryRow("select id, name from artists where id = $1", artistId).Scan(&artistId, &artist.Name)
+  if err != nil {
+    return artist, err
+  }
+  artist.Id = strconv.Itoa(artistId)
+  artist.Albums, err = loadSubsonicAlbums(db, "select " + subsonicAlbumColumns + " from " + subsonicAlbumTables +
+    " where artist.id = $1 and album.library = any($2) group by album.id, artist.id order by album.sort_title",
+    artistId, selectedLibraryNames())
+  if err == nil && len(artist.Albums) == 0 {
+    // The artist has no albums in the selected libraries.
+    err = sql.ErrNoRows
+  }
+  artist.AlbumCount = len(artist.Albums)
+  return artist, err
+}
+
+func loadSubsonicAlbum(db *sql.DB, albumId int) (subsonicAlbum, error) {
+  album, err := scanSubsonicAlbum(db.QueryRow("select " + subsonicAlbumColumns + " from " + subsonicAlbumTables +
+    " where album.id = $1 and album.library = any($2) group by album.id, artist.id", albumId, selectedLibraryNames()))
+  if err != nil {
+    return album, err
+  }
+  album.Songs, err = loadSubsonicSongs(db, "select " + subsonicSongColumns + " from " + subsonicSongTables +
+    " where album.id = $1 order by song.disc_number, song.track_number", albumId)
+  return album, err
+}
+
+func loadSubsonicSong(db *sql.DB, songId int) (subsonicSong, error) {
+  return scanSubsonicSong(db.QueryRow("select " + subsonicSongColumns + " from " + subsonicSongTables +
+    " where song.id = $1 and album.library = any($2)", songId, selectedLibraryNames()))
+}
+
+// Convert the words of a query into a query for to_tsquery that matches words
+// beginning with each of them, as clients search while the user is typing.
+func prefixTsQuery(query string) string {
+  words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+    return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+  })
+  for i, word := range(words) {
+    words[i] = word + ":*"
+  }
+  return strings.Join(words, " & ")
+}
+
+// Search the artists, albums and songs.  An empty query matches everything,
+// which clients use to download the whole library.
+func searchSubsonic(db *sql.DB, query string, artistCount, artistOffset, albumCount, albumOffset,
+    songCount, songOffset int) (subsonicSearchResult3, error) {
+  var result subsonicSearchResult3
+  var err error
+  tsQuery := prefixTsQuery(query)
+  libraries := selectedLibraryNames()
+  result.Artists, _, err = loadSubsonicArtists(db, `select artist.id, artist.name, artist.sort_name, count(album.id)
+    from artists artist join albums album on album.artist = artist.id
+    where album.library = any($1) and ($2 = '' or artist.search @@ to_tsquery('simple', $2))
+    group by artist.id order by artist.sort_name limit $3 offset $4`, libraries, tsQuery, artistCount, artistOffset)
+  if err != nil {
+    return result, err
+  }
+  result.Albums, err = loadSubsonicAlbums(db, "select " + subsonicAlbumColumns + " from " + subsonicAlbumTables +
+    " where album.library = any($1) and ($2 = '' or album.search @@ to_tsquery('simple', $2))" +
+    " group by album.id, artist.id order by album.sort_title limit $3 offset $4", libraries, tsQuery, albumCount, albumOffset)
+  if err != nil {
+    return result, err
+  }
+  result.Songs, err = loadSubsonicSongs(db, "select " + subsonicSongColumns + " from " + subsonicSongTables +
+    " where album.library = any($1) and ($2 = '' or (song.search || album.search || artist.search) @@ to_tsquery('simple', $2))" +
+    " order by artist.sort_name, album.sort_title, song.disc_number, song.track_number limit $3 offset $4",
+    libraries, tsQuery, songCount, songOffset)
+  return result, err
+}
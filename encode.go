@@ -1,126 +1,409 @@
 package main
 
 import (
+  "context"
+  "database/sql"
   "fmt"
-  "io"
-  "io/ioutil"
   "log"
   "os"
-  "os/exec"
   "path"
   "path/filepath"
+  "runtime"
   "strconv"
+  "strings"
+  "sync"
+  "unicode/utf8"
   "github.com/urfave/cli/v2"
   "github.com/brothertoad/btu"
 )
 
+const retryFailedFlag = "retry-failed"
+const listFailedFlag = "list-failed"
+const pruneFlag = "prune"
+
 var encodeCommand = cli.Command {
   Name: "encode",
   Usage: "encode the database",
+  Flags: []cli.Flag {
+    &cli.IntFlag {Name: jobsFlag, Aliases: []string{"j"}, Value: runtime.NumCPU(), Usage: "number of files to encode concurrently"},
+    &cli.BoolFlag {Name: retryFailedFlag, Usage: "only encode the songs that failed to encode before"},
+    &cli.BoolFlag {Name: listFailedFlag, Usage: "list the songs that failed to encode, with the encoder's output, and exit"},
+    &cli.BoolFlag {Name: pruneFlag, Usage: "remove files from the encoder directories that aren't the output of any song"},
+    &cli.BoolFlag {Name: dryRunFlag, Aliases: []string{"n"}, Usage: "with --prune, list the files that would be removed, without encoding anything"},
+  },
   Action: doEncode,
 }
 
-type extendedEncoderInfo struct {
-  EncoderInfo
-  inputIndex int
-  outputIndex int
+// Encoding a song with one encoder (or copying it, if it is already encoded).
+type encodeTask struct {
+  songIndex int
+  encoder EncoderInfo
+}
+
+type encodeResult struct {
+  task encodeTask
+  stderr string
+  err error
 }
 
+// Only the end of an encoder's output is kept when it fails, as that is
+// where the reason for the failure usually is.
+const maxFailureOutput = 16 * 1024
+
 func doEncode(c *cli.Context) error {
+  if c.Int(jobsFlag) < 1 {
+    return fmt.Errorf("--%s must be at least 1", jobsFlag)
+  }
+  if c.Bool(dryRunFlag) && !c.Bool(pruneFlag) {
+    return fmt.Errorf("--%s can only be used with --%s", dryRunFlag, pruneFlag)
+  }
   db := getDbConnection()
   defer db.Close()
+  return forEachLibrary(func() error {
+    if c.Bool(listFailedFlag) {
+      return listEncodeFailures(db)
+    }
+    return encodeLibrary(c, db)
+  })
+}
+
+func encodeLibrary(c *cli.Context, db *sql.DB) error {
   songs := readSongListFromDb(db)
+  validateEncoders(library)
+  if !c.Bool(dryRunFlag) {
+    if err := encodeSongs(c, db, songs); err != nil {
+      return err
+    }
+  }
+  if c.Bool(pruneFlag) {
+    return pruneEncoderOutputs(songs, c.Bool(dryRunFlag))
+  }
+  return nil
+}
+
+// Encode the songs of the current library that each encoder hasn't encoded
+// since they last changed.  Each song is encoded by each encoder as a
+// separate task, and the tasks are run by a pool of workers.  Only this
+// goroutine updates the database and prints progress, so updates and output
+// aren't interleaved.  A task that fails is recorded in the encode_failures
+// table, and the other tasks carry on.
+func encodeSongs(c *cli.Context, db *sql.DB, songs []Song) error {
+  jobs := c.Int(jobsFlag)
   fmt.Printf("%d songs are candidates for encoding\n", len(songs))
 
-  validateEncoders()
+  // When retrying, only the encoders that failed for each song are run.
+  var retry map[int]map[string]bool
+  if c.Bool(retryFailedFlag) {
+    var err error
+    retry, err = readEncodeFailures(db)
+    if err != nil {
+      return err
+    }
+    fmt.Printf("%d songs failed to encode before\n", len(retry))
+  }
 
-  for _, song := range(songs) {
-    // Regardless of whether or not the source file is already encoded,
-    // if there is an encodedSourceMd5 and it matches the current Md5,
-    // we don't need to do anything.
-    if song.SizeAndTime == song.EncodedSource {
+  // The size and time of each song when each encoder last encoded it.
+  encodings, err := readSongEncodings(db)
+  if err != nil {
+    return err
+  }
+  tagsById, err := readSongTagsFromDb(db)
+  if err != nil {
+    return err
+  }
+
+  tasks := make([]encodeTask, 0)
+  seeded := 0
+  for i, song := range(songs) {
+    for _, encoder := range(library.Encoders) {
+      if retry != nil {
+        if retry[song.Id][encoder.Extension] {
+          tasks = append(tasks, encodeTask{i, encoder})
+        }
+        continue
+      }
+      outputPath, included := encodedPath(encoder, song)
+      if !included || encodings[song.Id][encoder.Extension] == song.SizeAndTime {
+        continue
+      }
+      // Before encodings were tracked for each encoder, encoded_source was
+      // set when every encoder had encoded the song.  If it is current, and
+      // the output exists, the encoder doesn't need to run again.
+      if encodings[song.Id][encoder.Extension] == "" && song.EncodedSource == song.SizeAndTime && btu.FileExists(outputPath) {
+        if err := recordSongEncoding(db, song.Id, encoder.Extension, song.SizeAndTime); err != nil {
+          return err
+        }
+        seeded++
+        continue
+      }
+      tasks = append(tasks, encodeTask{i, encoder})
+    }
+  }
+  if seeded > 0 {
+    fmt.Printf("%d files were already encoded\n", seeded)
+  }
+  if len(tasks) == 0 {
+    return nil
+  }
+  fmt.Printf("%d files to encode or copy with %d jobs\n", len(tasks), jobs)
+
+  taskChan := make(chan encodeTask)
+  resultChan := make(chan encodeResult)
+  // Closed to stop handing out tasks if the database can't be updated.
+  stop := make(chan struct{})
+  go func() {
+    defer close(taskChan)
+    for _, task := range(tasks) {
+      select {
+      case taskChan <- task:
+      case <-stop:
+        return
+      }
+    }
+  }()
+  var wg sync.WaitGroup
+  for j := 0; j < jobs; j++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for task := range(taskChan) {
+        song := songs[task.songIndex]
+        stderr, err := runEncodeTask(task, song, tagsById[song.Id])
+        resultChan <- encodeResult{task, stderr, err}
+      }
+    }()
+  }
+  go func() {
+    wg.Wait()
+    close(resultChan)
+  }()
+
+  numFailed := 0
+  done := 0
+  // The results are read until the workers are done, even after an error,
+  // as the workers would otherwise block sending them.
+  var dbErr error
+  for result := range(resultChan) {
+    done++
+    if dbErr != nil {
       continue
     }
+    song := &songs[result.task.songIndex]
+    extension := result.task.encoder.Extension
+    if result.err != nil {
+      numFailed++
+      fmt.Printf("[%d/%d] FAILED %s to %s: %s\n", done, len(tasks), song.RelativePath, extension, result.err.Error())
+      // Not being able to record the failure shouldn't stop the other tasks.
+      if err := recordEncodeFailure(db, song.Id, extension, result.err.Error(), result.stderr); err != nil {
+        log.Printf("Can't record the failure of %s to %s: %s\n", song.RelativePath, extension, err.Error())
+      }
+      continue
+    }
+    action := "Encoded"
     if song.IsEncoded {
-      copySong(song)
+      action = "Copied"
+    }
+    fmt.Printf("[%d/%d] %s %s to %s\n", done, len(tasks), action, song.RelativePath, extension)
+    dbErr = recordSongEncoding(db, song.Id, extension, song.SizeAndTime)
+    if dbErr == nil {
+      dbErr = clearEncodeFailure(db, song.Id, extension)
+    }
+    if dbErr != nil {
+      close(stop)
+    }
+  }
+  if dbErr != nil {
+    return dbErr
+  }
+  if numFailed > 0 {
+    fmt.Printf("%d of %d files failed; use --%s to see why, and --%s to try them again\n",
+      numFailed, len(tasks), listFailedFlag, retryFailedFlag)
+  }
+  return nil
+}
+
+// Returns the end of the encoder's output along with any error.  If the
+// encoder writes tags or gain tags, they are written after the file is
+// encoded or copied.
+func runEncodeTask(task encodeTask, song Song, t songTags) (string, error) {
+  var stderr string
+  var err error
+  if song.IsEncoded {
+    err = copySong(task.encoder, song)
+  } else {
+    stderr, err = encodeSong(task.encoder, song, t)
+  }
+  if err != nil || !(task.encoder.Tags || task.encoder.GainTags) {
+    return stderr, err
+  }
+  outputPath, _ := encodedPath(task.encoder, song)
+  if err := writeTags(outputPath, t, task.encoder.Tags, task.encoder.GainTags); err != nil {
+    return stderr, fmt.Errorf("writing tags: %s", err.Error())
+  }
+  return stderr, nil
+}
+
+// Remove the files in each encoder directory that aren't the output of a song
+// of the current library, such as the outputs of songs that were deleted or
+// moved.
+func pruneEncoderOutputs(songs []Song, dryRun bool) error {
+  for _, encoder := range(library.Encoders) {
+    if pathContains(encoder.Directory, library.MusicDir) || pathContains(library.MusicDir, encoder.Directory) {
+      return fmt.Errorf("not pruning encoder %s, as its directory overlaps the music directory", encoder.Extension)
+    }
+    if other := sharedEncoderLibrary(encoder); other != "" {
+      return fmt.Errorf("not pruning encoder %s, as its directory overlaps an encoder directory of library %s", encoder.Extension, other)
+    }
+    wanted := make(map[string]bool, len(songs))
+    for _, song := range(songs) {
+      if outputPath, included := encodedPath(encoder, song); included {
+        wanted[filepath.Clean(outputPath)] = true
+      }
+    }
+    removed, err := pruneTree(filepath.Clean(encoder.Directory), func(p string) bool {
+      return wanted[p]
+    }, dryRun)
+    if err != nil {
+      return err
+    }
+    if dryRun {
+      fmt.Printf("Encoder %s: %d files would be removed\n", encoder.Extension, removed)
     } else {
-      encodeSong(song)
+      fmt.Printf("Encoder %s: %d files removed\n", encoder.Extension, removed)
+    }
+  }
+  return nil
+}
+
+// Returns the name of another library with an encoder whose directory
+// overlaps the directory of the given encoder, or "" if there isn't one.
+// Pruning such a directory would remove the other library's outputs, as
+// only the songs of the current library are known.
+func sharedEncoderLibrary(encoder EncoderInfo) string {
+  dir, _ := filepath.Abs(encoder.Directory)
+  for i := range(config.Libraries) {
+    lib := &config.Libraries[i]
+    if lib == library {
+      continue
+    }
+    for _, other := range(lib.Encoders) {
+      // The encoders of other libraries haven't been validated, so their
+      // default directories haven't been set.
+      otherDir := other.Directory
+      if otherDir == "" {
+        otherDir = lib.MusicDir + "-" + other.Extension
+      }
+      otherDir, _ = filepath.Abs(otherDir)
+      if pathContains(dir, otherDir) || pathContains(otherDir, dir) {
+        return lib.Name
+      }
     }
-    song.EncodedSource = song.SizeAndTime
-    updateSongEncodedSource(db, song)
   }
+  return ""
+}
+
+func listEncodeFailures(db *sql.DB) error {
+  failures, err := readEncodeFailureList(db)
+  if err != nil {
+    return err
+  }
+  for _, failure := range(failures) {
+    fmt.Printf("%s (%s, %s): %s\n", failure.RelativePath, failure.Encoder, failure.Failed.Format("2006-01-02 15:04:05"), failure.Error)
+    if output := strings.TrimSpace(failure.Stderr); output != "" {
+      fmt.Printf("  %s\n", strings.ReplaceAll(output, "\n", "\n  "))
+    }
+  }
+  fmt.Printf("%d failures\n", len(failures))
   return nil
 }
 
-// Get the input and output indices for each encoder, and set the output
+// Set the backend of each encoder of the library, and set the output
 // directory if it was not explicitly specified.
-func validateEncoders() {
-  for i, encoder := range(config.Encoders) {
+func validateEncoders(lib *LibraryInfo) {
+  for i, encoder := range(lib.Encoders) {
     if encoder.Extension == "" {
       log.Fatalf("Encoder %v does not have an extension\n", encoder)
     }
-    inputIndex := -1
-    outputIndex := -1
-    for j, arg := range(encoder.Commands) {
-      if arg == "$INPUT" {
-        inputIndex = j
-      } else if arg == "$OUTPUT" {
-        outputIndex = j
-      }
+    if (encoder.Tags || encoder.GainTags) && !containsString(taggableExtensions, strings.ToLower(encoder.Extension)) {
+      log.Fatalf("Encoder %s writes tags, but tags can only be written to %s files\n",
+        encoder.Extension, strings.Join(taggableExtensions, ", "))
     }
-    if inputIndex < 0 || outputIndex < 0 {
-      log.Fatalf("Missing either $INPUT or $OUTPUT for encoder %+v\n", encoder)
-    }
-    config.Encoders[i].inputIndex = inputIndex
-    config.Encoders[i].outputIndex = outputIndex
+    setEncoderBackend(&lib.Encoders[i])
     if encoder.Directory == "" {
-      config.Encoders[i].Directory = config.MusicDir + "-" + config.Encoders[i].Extension
+      lib.Encoders[i].Directory = lib.MusicDir + "-" + lib.Encoders[i].Extension
     }
     // Set includeOthers based on string provided in yaml file.  Note that the default
     // is true, which is why we can't just use a bool in the yaml file.
     if encoder.IncludeOtherEncodings == "" {
-      config.Encoders[i].includeOthers = true
+      lib.Encoders[i].includeOthers = true
     } else {
       includeOthers, err := strconv.ParseBool(encoder.IncludeOtherEncodings)
       btu.CheckError(err)
-      config.Encoders[i].includeOthers = includeOthers
+      lib.Encoders[i].includeOthers = includeOthers
     }
   }
 }
 
-func copySong(song Song) {
-  src := path.Join(config.MusicDir, song.RelativePath)
-  for _, encoder := range(config.Encoders) {
-    // We only copy the file if the extension is the same as the encoder,
-    // or if the encoder is configured to include other encodings.
-    if song.Extension == encoder.Extension || encoder.includeOthers {
-      fmt.Printf("Copying %s...\n", song.RelativePath)
-      dest := path.Join(encoder.Directory, song.BasePath + song.EncodedExtension)
-      err := os.MkdirAll(filepath.Dir(dest), 0775)
-      btu.CheckError(err)
-      bytes, err := ioutil.ReadFile(src)
-      btu.CheckError(err)
-      err = ioutil.WriteFile(dest, bytes, 0644)
-    }
+// Returns the path of the file an encoder makes for a song, and whether the
+// encoder makes one at all.  Songs that are already encoded are copied rather
+// than encoded, but only if the extension is the same as the encoder, or if
+// the encoder is configured to include other encodings.
+func encodedPath(encoder EncoderInfo, song Song) (string, bool) {
+  if song.IsEncoded {
+    return path.Join(encoder.Directory, song.BasePath + song.EncodedExtension), song.Extension == encoder.Extension || encoder.includeOthers
+  }
+  return path.Join(encoder.Directory, song.BasePath + encoder.Extension), true
+}
+
+// Copy a song that is already encoded to an encoder's directory.  The copy is
+// made by the encoder's backend, so it is done the same way as encoding.
+func copySong(encoder EncoderInfo, song Song) error {
+  src := path.Join(library.MusicDir, song.RelativePath)
+  dest, _ := encodedPath(encoder, song)
+  if err := os.MkdirAll(filepath.Dir(dest), 0775); err != nil {
+    return err
+  }
+  return encoder.backend.Encode(context.Background(), encodeRequest{InputPath: src, OutputPath: dest, Copy: true})
+}
+
+// Encode a song with an encoder's backend.  The tag placeholders in the
+// encoder's commands are replaced with the song's tags.
+func encodeSong(encoder EncoderInfo, song Song, t songTags) (string, error) {
+  inputPath := path.Join(library.MusicDir, song.RelativePath)
+  outputPath, _ := encodedPath(encoder, song)
+  if err := os.MkdirAll(filepath.Dir(outputPath), 0775); err != nil {
+    return "", err
+  }
+  var stderr tailBuffer
+  err := encoder.backend.Encode(context.Background(), encodeRequest{
+    InputPath: inputPath,
+    OutputPath: outputPath,
+    Stderr: &stderr,
+    Tags: t,
+  })
+  return stderr.String(), err
+}
+
+// Keeps the last maxFailureOutput bytes written to it.
+type tailBuffer struct {
+  data []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+  b.data = append(b.data, p...)
+  if len(b.data) > maxFailureOutput {
+    b.data = b.data[len(b.data) - maxFailureOutput:]
   }
+  return len(p), nil
 }
 
-func encodeSong(song Song) {
-  fmt.Printf("Encoding %s...\n", song.RelativePath)
-  inputPath := path.Join(config.MusicDir, song.RelativePath)
-  for _, encoder := range(config.Encoders) {
-    outputPath := path.Join(encoder.Directory, song.BasePath + encoder.Extension)
-    err := os.MkdirAll(filepath.Dir(outputPath), 0775)
-    btu.CheckError(err)
-    encoder.Commands[encoder.inputIndex] = inputPath
-    encoder.Commands[encoder.outputIndex] = outputPath
-    cmd := exec.Command(encoder.Commands[0], encoder.Commands[1:]...)
-    stderr, err := cmd.StderrPipe()
-    btu.CheckError(err)
-    err = cmd.Start()
-    btu.CheckError(err)
-    _, _ = io.ReadAll(stderr)
-    err = cmd.Wait()
-    btu.CheckError(err)
+// Returns the output as valid UTF-8, which the database requires.  The start
+// of the output may be part of a character that was cut off, which is
+// skipped, and any other invalid bytes are dropped.
+func (b *tailBuffer) String() string {
+  data := b.data
+  for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.RuneStart(data[0]); i++ {
+    data = data[1:]
   }
+  return strings.ToValidUTF8(string(data), "")
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "unicode/utf8"
+)
+
+func TestTailBuffer(t *testing.T) {
+  euro := "€"
+  tests := []struct {
+    name string
+    writes []string
+    want string
+  }{
+    {"short", []string{"error: ", "bad input\n"}, "error: bad input\n"},
+    {"truncated", []string{strings.Repeat("a", 10), strings.Repeat("b", maxFailureOutput)}, strings.Repeat("b", maxFailureOutput)},
+    {"keeps the end", []string{strings.Repeat("a", maxFailureOutput), "end"}, strings.Repeat("a", maxFailureOutput - 3) + "end"},
+    // The buffer starts with the last byte of the euro sign, which is dropped.
+    {"cut character", []string{euro, strings.Repeat("x", maxFailureOutput - 1)}, strings.Repeat("x", maxFailureOutput - 1)},
+    {"invalid bytes", []string{"a\xffb\xc3", "c"}, "abc"},
+    {"multibyte", []string{"caf", "é ", euro}, "café " + euro},
+    {"empty", nil, ""},
+  }
+  for _, test := range(tests) {
+    var b tailBuffer
+    for _, s := range(test.writes) {
+      if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+        t.Errorf("%s: Write = %d, %v, want %d, nil", test.name, n, err, len(s))
+      }
+    }
+    got := b.String()
+    if !utf8.ValidString(got) {
+      t.Errorf("%s: output isn't valid UTF-8", test.name)
+    }
+    if len(b.data) > maxFailureOutput {
+      t.Errorf("%s: kept %d bytes, more than %d", test.name, len(b.data), maxFailureOutput)
+    }
+    if got != test.want {
+      t.Errorf("%s: got %d bytes %.40q, want %d bytes %.40q", test.name, len(got), got, len(test.want), test.want)
+    }
+  }
+}
+
+func TestPruneEncoderOutputs(t *testing.T) {
+  root := t.TempDir()
+  savedLibrary, savedLibraries := library, config.Libraries
+  t.Cleanup(func() { library, config.Libraries = savedLibrary, savedLibraries })
+  config.Libraries = []LibraryInfo{
+    {Name: "main", MusicDir: filepath.Join(root, "music"), Encoders: []EncoderInfo{{Extension: ".mp3", Directory: filepath.Join(root, "mp3")}}},
+    {Name: "other", MusicDir: filepath.Join(root, "other"), Encoders: []EncoderInfo{{Extension: ".mp3"}}},
+  }
+  library = &config.Libraries[0]
+  writeTestFile(t, filepath.Join(root, "mp3", "a", "one.mp3"), "one")
+  writeTestFile(t, filepath.Join(root, "mp3", "a", "gone.mp3"), "gone")
+  writeTestFile(t, filepath.Join(root, "mp3", "b", "gone.mp3"), "gone")
+  songs := []Song{{Id: 1, RelativePath: "/a/one.flac", BasePath: "/a/one", Extension: ".flac"}}
+
+  if err := pruneEncoderOutputs(songs, true); err != nil {
+    t.Fatalf("dry run: %v", err)
+  }
+  if _, err := os.Stat(filepath.Join(root, "mp3", "a", "gone.mp3")); err != nil {
+    t.Errorf("dry run removed a file")
+  }
+
+  if err := pruneEncoderOutputs(songs, false); err != nil {
+    t.Fatalf("pruneEncoderOutputs: %v", err)
+  }
+  if _, err := os.Stat(filepath.Join(root, "mp3", "a", "one.mp3")); err != nil {
+    t.Errorf("output of a song was removed: %v", err)
+  }
+  for _, p := range([]string{filepath.Join("a", "gone.mp3"), "b"}) {
+    if _, err := os.Stat(filepath.Join(root, "mp3", p)); !os.IsNotExist(err) {
+      t.Errorf("%s was not removed", p)
+    }
+  }
+
+  // The outputs of another library that uses the same directory aren't
+  // known, so the directory isn't pruned.
+  config.Libraries[1].Encoders[0].Directory = filepath.Join(root, "mp3")
+  writeTestFile(t, filepath.Join(root, "mp3", "c", "other.mp3"), "other")
+  if err := pruneEncoderOutputs(songs, false); err == nil {
+    t.Errorf("pruned a directory another library uses")
+  }
+  if _, err := os.Stat(filepath.Join(root, "mp3", "c", "other.mp3")); err != nil {
+    t.Errorf("output of another library was removed: %v", err)
+  }
+}
+
+func TestSharedEncoderLibrary(t *testing.T) {
+  savedLibrary, savedLibraries := library, config.Libraries
+  t.Cleanup(func() { library, config.Libraries = savedLibrary, savedLibraries })
+  config.Libraries = []LibraryInfo{
+    {Name: "main", MusicDir: "/music", Encoders: []EncoderInfo{{Extension: ".mp3", Directory: "/music-.mp3"}, {Extension: ".ogg", Directory: "/ogg"}}},
+    {Name: "classical", MusicDir: "/classical", Encoders: []EncoderInfo{{Extension: ".mp3", Directory: "/ogg/classical"}}},
+    {Name: "spoken", MusicDir: "/music", Encoders: []EncoderInfo{{Extension: ".mp3"}}},
+  }
+  library = &config.Libraries[0]
+  tests := []struct {
+    encoder EncoderInfo
+    want string
+  }{
+    {library.Encoders[0], "spoken"},
+    {library.Encoders[1], "classical"},
+    {EncoderInfo{Extension: ".opus", Directory: "/opus"}, ""},
+  }
+  for _, test := range(tests) {
+    if got := sharedEncoderLibrary(test.encoder); got != test.want {
+      t.Errorf("%s: got %q, want %q", test.encoder.Directory, got, test.want)
+    }
+  }
+}
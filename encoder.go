@@ -0,0 +1,123 @@
+package main
+
+import (
+  "context"
+  "fmt"
+  "io"
+  "log"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "strconv"
+  "strings"
+)
+
+// An Encoder makes a file in another format (or the same one) from the file
+// of a song.  Encoders are used both by the encode command, which writes to
+// files in the encoder directories, and by the transcoding done by serve,
+// which writes to the response.
+type Encoder interface {
+  Encode(ctx context.Context, req encodeRequest) error
+}
+
+type encodeRequest struct {
+  InputPath string
+  // The file to write.  If it is empty, the output is written to Output.
+  OutputPath string
+  Output io.Writer
+  // Where an encoder's messages go.  May be nil.
+  Stderr io.Writer
+  // The values for the placeholders in an encoder's commands.
+  Tags songTags
+  Bitrate int
+  // The song is already encoded, so it is copied rather than encoded, even
+  // if its extension isn't the encoder's.
+  Copy bool
+}
+
+// Set the backend of an encoder from its configuration.  An encoder with
+// commands runs them, and an encoder without any copies the file.
+func setEncoderBackend(encoder *EncoderInfo) {
+  if len(encoder.Commands) == 0 {
+    encoder.backend = copyEncoder{encoder.Extension}
+    return
+  }
+  inputIndex := -1
+  outputIndex := -1
+  for j, arg := range(encoder.Commands) {
+    if arg == "$INPUT" {
+      inputIndex = j
+    } else if arg == "$OUTPUT" {
+      outputIndex = j
+    }
+  }
+  if inputIndex < 0 || outputIndex < 0 {
+    log.Fatalf("Missing either $INPUT or $OUTPUT for encoder %+v\n", *encoder)
+  }
+  encoder.backend = commandEncoder{encoder.Commands, inputIndex, outputIndex}
+}
+
+// Runs an external program, such as lame or ffmpeg.  $INPUT and $OUTPUT in
+// the commands are replaced with the paths of the input and output, where
+// an output of "-" means stdout.  $BITRATE and the tag placeholders are
+// replaced wherever they appear.
+type commandEncoder struct {
+  commands []string
+  inputIndex int
+  outputIndex int
+}
+
+func (enc commandEncoder) Encode(ctx context.Context, req encodeRequest) error {
+  if req.Copy {
+    return copyEncoder{}.Encode(ctx, req)
+  }
+  args := enc.args(req)
+  cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+  cmd.Stderr = req.Stderr
+  if req.OutputPath == "" {
+    cmd.Stdout = req.Output
+  }
+  return cmd.Run()
+}
+
+// Returns the commands for a request.  They are copied, as the same encoder
+// may be running for other songs at the same time.
+func (enc commandEncoder) args(req encodeRequest) []string {
+  args := make([]string, len(enc.commands))
+  replacer := tagReplacer(req.Tags)
+  for j, arg := range(enc.commands) {
+    args[j] = replacer.Replace(strings.ReplaceAll(arg, "$BITRATE", strconv.Itoa(req.Bitrate)))
+  }
+  args[enc.inputIndex] = req.InputPath
+  args[enc.outputIndex] = req.OutputPath
+  if req.OutputPath == "" {
+    args[enc.outputIndex] = "-"
+  }
+  return args
+}
+
+// Copies the file without changing it.  If extension is not empty, only
+// files with that extension can be copied, so an encoder without commands
+// doesn't give a file the wrong extension.
+type copyEncoder struct {
+  extension string
+}
+
+func (enc copyEncoder) Encode(ctx context.Context, req encodeRequest) error {
+  if enc.extension != "" && !req.Copy && !strings.EqualFold(filepath.Ext(req.InputPath), enc.extension) {
+    return fmt.Errorf("can't copy %s to %s without an encoder command", filepath.Ext(req.InputPath), enc.extension)
+  }
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  if req.OutputPath != "" {
+    return copyFile(req.InputPath, req.OutputPath)
+  }
+  in, err := os.Open(req.InputPath)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  _, err = io.Copy(req.Output, in)
+  return err
+}
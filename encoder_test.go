@@ -0,0 +1,179 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+// Records the requests it gets, and writes its output to the output file.
+type fakeEncoder struct {
+  requests []encodeRequest
+  stderr string
+  err error
+}
+
+func (enc *fakeEncoder) Encode(ctx context.Context, req encodeRequest) error {
+  enc.requests = append(enc.requests, req)
+  if req.Stderr != nil {
+    fmt.Fprint(req.Stderr, enc.stderr)
+  }
+  if enc.err != nil {
+    return enc.err
+  }
+  return os.WriteFile(req.OutputPath, []byte("encoded"), 0644)
+}
+
+// Makes the current library point at temporary directories, restoring it
+// when the test is done.
+func setTestLibrary(t *testing.T) *LibraryInfo {
+  saved := library
+  t.Cleanup(func() { library = saved })
+  library = &LibraryInfo{Name: "test", MusicDir: t.TempDir()}
+  return library
+}
+
+func TestEncodeSong(t *testing.T) {
+  lib := setTestLibrary(t)
+  fake := &fakeEncoder{stderr: "warning"}
+  encoder := EncoderInfo{Extension: ".mp3", Directory: t.TempDir(), backend: fake}
+  song := Song{RelativePath: "/Artist/Album/01 Song.flac", BasePath: "/Artist/Album/01 Song", Extension: ".flac"}
+  metadata := songTags{Title: "Song", Artist: "Artist", Album: "Album", Track: 1, Disc: 1}
+
+  stderr, err := encodeSong(encoder, song, metadata)
+  if err != nil {
+    t.Fatalf("encodeSong: %v", err)
+  }
+  if stderr != "warning" {
+    t.Errorf("stderr = %q, want %q", stderr, "warning")
+  }
+  if len(fake.requests) != 1 {
+    t.Fatalf("got %d requests, want 1", len(fake.requests))
+  }
+  req := fake.requests[0]
+  if want := filepath.Join(lib.MusicDir, song.RelativePath); req.InputPath != want {
+    t.Errorf("InputPath = %q, want %q", req.InputPath, want)
+  }
+  if want := filepath.Join(encoder.Directory, "Artist/Album/01 Song.mp3"); req.OutputPath != want {
+    t.Errorf("OutputPath = %q, want %q", req.OutputPath, want)
+  }
+  if req.Copy {
+    t.Errorf("Copy is set for a song that isn't encoded")
+  }
+  if !reflect.DeepEqual(req.Tags, metadata) {
+    t.Errorf("Tags = %+v, want %+v", req.Tags, metadata)
+  }
+}
+
+func TestRunEncodeTask(t *testing.T) {
+  failure := errors.New("failed")
+  tests := []struct {
+    name string
+    song Song
+    err error
+    wantCopy bool
+    wantOutput string
+    wantStderr string
+  }{
+    {"encode", Song{RelativePath: "/a/b/song.flac", BasePath: "/a/b/song", Extension: ".flac"}, nil, false, "a/b/song.mp3", "output"},
+    {"copy", Song{RelativePath: "/a/b/song.ogg", BasePath: "/a/b/song", Extension: ".ogg", EncodedExtension: ".ogg", IsEncoded: true}, nil, true, "a/b/song.ogg", ""},
+    {"failure", Song{RelativePath: "/a/b/song.flac", BasePath: "/a/b/song", Extension: ".flac"}, failure, false, "a/b/song.mp3", "output"},
+  }
+  for _, test := range(tests) {
+    t.Run(test.name, func(t *testing.T) {
+      setTestLibrary(t)
+      fake := &fakeEncoder{stderr: "output", err: test.err}
+      encoder := EncoderInfo{Extension: ".mp3", Directory: t.TempDir(), includeOthers: true, backend: fake}
+      stderr, err := runEncodeTask(encodeTask{0, encoder}, test.song, songTags{})
+      if err != test.err {
+        t.Errorf("err = %v, want %v", err, test.err)
+      }
+      if stderr != test.wantStderr {
+        t.Errorf("stderr = %q, want %q", stderr, test.wantStderr)
+      }
+      if len(fake.requests) != 1 {
+        t.Fatalf("got %d requests, want 1", len(fake.requests))
+      }
+      req := fake.requests[0]
+      if req.Copy != test.wantCopy {
+        t.Errorf("Copy = %v, want %v", req.Copy, test.wantCopy)
+      }
+      if want := filepath.Join(encoder.Directory, test.wantOutput); req.OutputPath != want {
+        t.Errorf("OutputPath = %q, want %q", req.OutputPath, want)
+      }
+    })
+  }
+}
+
+func TestCopyEncoder(t *testing.T) {
+  dir := t.TempDir()
+  input := filepath.Join(dir, "song.mp3")
+  if err := os.WriteFile(input, []byte("music"), 0644); err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    encoder copyEncoder
+    copy bool
+    wantErr bool
+  }{
+    {"any extension", copyEncoder{}, false, false},
+    {"same extension", copyEncoder{".mp3"}, false, false},
+    {"other extension", copyEncoder{".ogg"}, false, true},
+    {"other extension, already encoded", copyEncoder{".ogg"}, true, false},
+  }
+  for _, test := range(tests) {
+    t.Run(test.name, func(t *testing.T) {
+      var out bytes.Buffer
+      err := test.encoder.Encode(context.Background(), encodeRequest{InputPath: input, Output: &out, Copy: test.copy})
+      if (err != nil) != test.wantErr {
+        t.Fatalf("err = %v, want error %v", err, test.wantErr)
+      }
+      if err == nil && out.String() != "music" {
+        t.Errorf("output = %q, want %q", out.String(), "music")
+      }
+    })
+  }
+
+  output := filepath.Join(dir, "copy.mp3")
+  if err := (copyEncoder{}).Encode(context.Background(), encodeRequest{InputPath: input, OutputPath: output}); err != nil {
+    t.Fatalf("copying to a file: %v", err)
+  }
+  if data, err := os.ReadFile(output); err != nil || string(data) != "music" {
+    t.Errorf("copy = %q, %v, want %q", data, err, "music")
+  }
+}
+
+func TestCommandEncoderArgs(t *testing.T) {
+  encoder := EncoderInfo{Extension: ".mp3", Commands: []string{"lame", "-b", "$BITRATE", "--tt", "$TITLE", "--ta", "$ARTIST", "$INPUT", "$OUTPUT"}}
+  setEncoderBackend(&encoder)
+  enc, ok := encoder.backend.(commandEncoder)
+  if !ok {
+    t.Fatalf("backend is %T, want commandEncoder", encoder.backend)
+  }
+  metadata := songTags{Title: "Song", Artist: "Artist"}
+  tests := []struct {
+    name string
+    req encodeRequest
+    want []string
+  }{
+    {"file", encodeRequest{InputPath: "in.flac", OutputPath: "out.mp3", Tags: metadata, Bitrate: 192},
+      []string{"lame", "-b", "192", "--tt", "Song", "--ta", "Artist", "in.flac", "out.mp3"}},
+    {"stdout", encodeRequest{InputPath: "in.flac", Tags: metadata, Bitrate: 128},
+      []string{"lame", "-b", "128", "--tt", "Song", "--ta", "Artist", "in.flac", "-"}},
+  }
+  for _, test := range(tests) {
+    if got := enc.args(test.req); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: args = %q, want %q", test.name, got, test.want)
+    }
+  }
+  // The encoder's commands aren't changed.
+  if encoder.Commands[2] != "$BITRATE" {
+    t.Errorf("commands were changed: %q", encoder.Commands)
+  }
+}
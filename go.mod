@@ -3,8 +3,13 @@ module github.com/brothertoad/musiclib
 go 1.17
 
 require (
+	github.com/bogem/id3v2/v2 v2.1.4 // indirect
 	github.com/brothertoad/btu v0.0.0-20220627165445-9881c2d1fb54 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.1 // indirect
+	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8 // indirect
+	github.com/go-flac/flacpicture v0.3.0 // indirect
+	github.com/go-flac/flacvorbis v0.2.0 // indirect
+	github.com/go-flac/go-flac v1.0.0 // indirect
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
 	github.com/jackc/pgconn v1.12.1 // indirect
 	github.com/jackc/pgio v1.0.0 // indirect
@@ -18,6 +23,7 @@ require (
 	github.com/urfave/cli/v2 v2.8.1 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/image v0.10.0 // indirect
+	golang.org/x/text v0.3.8 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,305 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "math"
+  "os/exec"
+  "path"
+  "regexp"
+  "runtime"
+  "strconv"
+  "strings"
+  "sync"
+  "github.com/urfave/cli/v2"
+  "github.com/brothertoad/btu"
+)
+
+const allFlag = "all"
+const ffmpegFlag = "ffmpeg"
+
+var loudnessCommand = cli.Command {
+  Name: "loudness",
+  Usage: "compute the ReplayGain of songs, and of albums from the loudness of their songs (an approximation of measuring the album as one stream)",
+  Flags: []cli.Flag {
+    &cli.IntFlag {Name: jobsFlag, Aliases: []string{"j"}, Value: runtime.NumCPU(), Usage: "number of files to analyze concurrently"},
+    &cli.BoolFlag {Name: allFlag, Usage: "analyze every song, not just the ones that haven't been analyzed since they changed"},
+    &cli.StringFlag {Name: ffmpegFlag, Value: "ffmpeg", Usage: "path of the ffmpeg program"},
+  },
+  Action: doLoudness,
+}
+
+// The loudness of songs is measured with ffmpeg's ebur128 filter, and the
+// gains follow ReplayGain 2.0, which brings songs to a loudness of -18 LUFS.
+const referenceLoudness = -18.0
+
+type loudnessResult struct {
+  songIndex int
+  loudness float64
+  peak float64
+  err error
+}
+
+// The summary that the ebur128 filter logs at the end.
+var integratedLoudnessPattern = regexp.MustCompile(`I:\s+(-?[0-9.]+) LUFS`)
+var truePeakPattern = regexp.MustCompile(`Peak:\s+(-?[0-9.]+|-inf) dBFS`)
+
+func doLoudness(c *cli.Context) error {
+  if c.Int(jobsFlag) < 1 {
+    return fmt.Errorf("--%s must be at least 1", jobsFlag)
+  }
+  db := getDbConnection()
+  defer db.Close()
+  return forEachLibrary(func() error {
+    return analyzeLibrary(c, db)
+  })
+}
+
+// Measure the loudness of the songs of the current library that need it,
+// then update the gains of their albums, and the gain tags of the outputs of
+// the encoders that write them.  Like encode, the songs are analyzed by a
+// pool of workers, and only this goroutine updates the database.
+func analyzeLibrary(c *cli.Context, db *sql.DB) error {
+  jobs := c.Int(jobsFlag)
+  songs := readSongListFromDb(db)
+  sources, err := readLoudnessSources(db)
+  if err != nil {
+    return err
+  }
+  pending := make([]int, 0)
+  for i, song := range(songs) {
+    if c.Bool(allFlag) || sources[song.Id] != song.SizeAndTime {
+      pending = append(pending, i)
+    }
+  }
+  fmt.Printf("%d songs to analyze with %d jobs\n", len(pending), jobs)
+
+  taskChan := make(chan int)
+  resultChan := make(chan loudnessResult)
+  // Closed to stop handing out songs if the database can't be updated.
+  stop := make(chan struct{})
+  go func() {
+    defer close(taskChan)
+    for _, i := range(pending) {
+      select {
+      case taskChan <- i:
+      case <-stop:
+        return
+      }
+    }
+  }()
+  var wg sync.WaitGroup
+  for j := 0; j < jobs; j++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := range(taskChan) {
+        loudness, peak, err := measureLoudness(c.String(ffmpegFlag), path.Join(library.MusicDir, songs[i].RelativePath))
+        resultChan <- loudnessResult{i, loudness, peak, err}
+      }
+    }()
+  }
+  go func() {
+    wg.Wait()
+    close(resultChan)
+  }()
+
+  changed := make(map[int]bool)
+  numFailed := 0
+  done := 0
+  // As in encode, the results are read until the workers are done, even
+  // after an error.
+  var dbErr error
+  for result := range(resultChan) {
+    done++
+    if dbErr != nil {
+      continue
+    }
+    song := songs[result.songIndex]
+    if result.err != nil {
+      numFailed++
+      fmt.Printf("[%d/%d] FAILED %s: %s\n", done, len(pending), song.RelativePath, result.err.Error())
+      continue
+    }
+    gain := referenceLoudness - result.loudness
+    if verbose {
+      fmt.Printf("[%d/%d] %s: %.1f LUFS, gain %.2f dB, peak %.6f\n", done, len(pending), song.RelativePath, result.loudness, gain, result.peak)
+    }
+    dbErr = recordTrackLoudness(db, song.Id, result.loudness, gain, result.peak, song.SizeAndTime)
+    if dbErr != nil {
+      close(stop)
+      continue
+    }
+    changed[song.Id] = true
+  }
+  if dbErr != nil {
+    return dbErr
+  }
+  if numFailed > 0 {
+    fmt.Printf("%d of %d songs could not be analyzed\n", numFailed, len(pending))
+  }
+
+  changedAlbums, err := updateAlbumGains(db)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("%d songs analyzed, %d album gains changed\n", len(changed), len(changedAlbums))
+  // The songs of albums whose gain changed need new gain tags too.
+  if len(changedAlbums) > 0 {
+    albumSongs, err := readAlbumSongIds(db, changedAlbums)
+    if err != nil {
+      return err
+    }
+    for _, songId := range(albumSongs) {
+      changed[songId] = true
+    }
+  }
+  return writeGainTags(db, songs, changed)
+}
+
+// Returns the integrated loudness of a file in LUFS, and its true peak as a
+// linear amplitude.
+func measureLoudness(ffmpeg, inputPath string) (float64, float64, error) {
+  cmd := exec.Command(ffmpeg, "-nostdin", "-nostats", "-hide_banner", "-i", inputPath,
+    "-map", "0:a:0", "-filter:a", "ebur128=peak=true:framelog=verbose", "-f", "null", "-")
+  var stderr tailBuffer
+  cmd.Stderr = &stderr
+  if err := cmd.Run(); err != nil {
+    output := strings.TrimSpace(stderr.String())
+    if n := strings.LastIndex(output, "\n"); n >= 0 {
+      output = output[n + 1:]
+    }
+    return 0, 0, fmt.Errorf("%s: %s", err.Error(), output)
+  }
+  return parseLoudnessSummary(stderr.String())
+}
+
+func parseLoudnessSummary(output string) (float64, float64, error) {
+  n := strings.LastIndex(output, "Summary:")
+  if n < 0 {
+    return 0, 0, fmt.Errorf("no loudness summary in the output of ffmpeg")
+  }
+  summary := output[n:]
+  loudnessMatch := integratedLoudnessPattern.FindStringSubmatch(summary)
+  peakMatch := truePeakPattern.FindStringSubmatch(summary)
+  if loudnessMatch == nil || peakMatch == nil {
+    return 0, 0, fmt.Errorf("can't parse the loudness summary of ffmpeg")
+  }
+  loudness, err := strconv.ParseFloat(loudnessMatch[1], 64)
+  if err != nil {
+    return 0, 0, err
+  }
+  // A silent file has a peak of -inf dBFS.
+  peak := 0.0
+  if peakMatch[1] != "-inf" {
+    peakDb, err := strconv.ParseFloat(peakMatch[1], 64)
+    if err != nil {
+      return 0, 0, err
+    }
+    peak = math.Pow(10, peakDb / 20)
+  }
+  return loudness, peak, nil
+}
+
+// The loudness of a song, as it is needed to work out the gain of its album.
+type albumLoudnessEntry struct {
+  Duration string
+  Loudness *float64
+  Peak *float64
+  Current bool
+}
+
+type albumGains struct {
+  Gain *float64
+  Peak *float64
+}
+
+// Returns the gain and peak of an album, from the loudness of its songs, or
+// nil if any of the songs hasn't been analyzed since it last changed.  The
+// loudness of the album is the mean of the loudness of its songs, in terms of
+// energy and weighted by their durations.  This is only an approximation of
+// the EBU R128 loudness of the album as one stream, as each song was gated on
+// its own, and it differs more for albums with many quiet songs.
+func albumGain(entries []albumLoudnessEntry) (*float64, *float64) {
+  energy := 0.0
+  total := 0.0
+  peak := 0.0
+  for _, entry := range(entries) {
+    if !entry.Current || entry.Loudness == nil || entry.Peak == nil {
+      return nil, nil
+    }
+    seconds := float64(durationSeconds(entry.Duration))
+    if seconds < 1 {
+      seconds = 1
+    }
+    energy += seconds * math.Pow(10, *entry.Loudness / 10)
+    total += seconds
+    peak = math.Max(peak, *entry.Peak)
+  }
+  if total == 0 {
+    return nil, nil
+  }
+  gain := referenceLoudness - 10 * math.Log10(energy / total)
+  return &gain, &peak
+}
+
+// Set the gain and peak of each album of the current library, and return
+// the ids of the albums whose gain or peak changed.
+func updateAlbumGains(db *sql.DB) ([]int, error) {
+  entries, current, err := readAlbumLoudness(db)
+  if err != nil {
+    return nil, err
+  }
+  changed := make([]int, 0)
+  for albumId, albumEntries := range(entries) {
+    gain, peak := albumGain(albumEntries)
+    if sameGain(gain, current[albumId].Gain) && sameGain(peak, current[albumId].Peak) {
+      continue
+    }
+    if err := updateAlbumGain(db, albumId, gain, peak); err != nil {
+      return changed, err
+    }
+    changed = append(changed, albumId)
+  }
+  return changed, nil
+}
+
+func sameGain(a, b *float64) bool {
+  if a == nil || b == nil {
+    return a == b
+  }
+  return *a == *b
+}
+
+// Write the gain tags of the given songs into the outputs of the encoders
+// that write them.  Outputs that don't exist yet get the tags when they are
+// encoded.
+func writeGainTags(db *sql.DB, songs []Song, songIds map[int]bool) error {
+  validateEncoders(library)
+  var tagsById map[int]songTags
+  for _, encoder := range(library.Encoders) {
+    if !encoder.GainTags || len(songIds) == 0 {
+      continue
+    }
+    if tagsById == nil {
+      var err error
+      if tagsById, err = readSongTagsFromDb(db); err != nil {
+        return err
+      }
+    }
+    written := 0
+    for _, song := range(songs) {
+      outputPath, included := encodedPath(encoder, song)
+      if !songIds[song.Id] || !included || !btu.FileExists(outputPath) {
+        continue
+      }
+      if err := writeTags(outputPath, tagsById[song.Id], false, true); err != nil {
+        fmt.Printf("Can't write gain tags to %s: %s\n", outputPath, err.Error())
+        continue
+      }
+      written++
+    }
+    fmt.Printf("Encoder %s: wrote gain tags to %d files\n", encoder.Extension, written)
+  }
+  return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "testing"
+)
+
+func floatPtr(f float64) *float64 {
+  return &f
+}
+
+func TestParseLoudnessSummary(t *testing.T) {
+  tests := []struct {
+    name string
+    output string
+    wantErr bool
+    loudness float64
+    peak float64
+  }{
+    {"summary", "[Parsed_ebur128_0 @ 0x1] Summary:\n\n  Integrated loudness:\n    I:         -16.4 LUFS\n    Threshold: -26.7 LUFS\n\n  True peak:\n    Peak:        0.5 dBFS\n", false, -16.4, 1.0592537},
+    {"silence", "Summary:\n  Integrated loudness:\n    I:         -70.0 LUFS\n  True peak:\n    Peak:       -inf dBFS\n", false, -70, 0},
+    {"last summary", "Summary:\n    I: -30.0 LUFS\n    Peak: -6.0 dBFS\nSummary:\n    I: -10.0 LUFS\n    Peak: -20.0 dBFS\n", false, -10, 0.1},
+    {"frame lines only", "t: 0.1  M: -20.0 S: -120.7  I: -20.0 LUFS  Peak: -3.0 dBFS\n", true, 0, 0},
+    {"no peak", "Summary:\n    I: -16.4 LUFS\n", true, 0, 0},
+    {"empty", "", true, 0, 0},
+  }
+  for _, test := range(tests) {
+    loudness, peak, err := parseLoudnessSummary(test.output)
+    if (err != nil) != test.wantErr {
+      t.Errorf("%s: err = %v, want error %v", test.name, err, test.wantErr)
+      continue
+    }
+    if math.Abs(loudness - test.loudness) > 1e-6 || math.Abs(peak - test.peak) > 1e-6 {
+      t.Errorf("%s: got %v, %v, want %v, %v", test.name, loudness, peak, test.loudness, test.peak)
+    }
+  }
+}
+
+func TestAlbumGain(t *testing.T) {
+  entry := func(duration string, loudness, peak float64) albumLoudnessEntry {
+    return albumLoudnessEntry{duration, floatPtr(loudness), floatPtr(peak), true}
+  }
+  tests := []struct {
+    name string
+    entries []albumLoudnessEntry
+    gain *float64
+    peak *float64
+  }{
+    {"one song", []albumLoudnessEntry{entry("4:00", -14, 0.8)}, floatPtr(-4), floatPtr(0.8)},
+    {"energy mean", []albumLoudnessEntry{entry("3:00", -10, 0.9), entry("3:00", -20, 0.5)}, floatPtr(-5.403627), floatPtr(0.9)},
+    {"weighted by duration", []albumLoudnessEntry{entry("9:00", -20, 0.5), entry("1:00", -10, 0.7)}, floatPtr(-0.787536), floatPtr(0.7)},
+    {"no duration", []albumLoudnessEntry{entry("", -18, 0.5)}, floatPtr(0), floatPtr(0.5)},
+    {"not current", []albumLoudnessEntry{entry("3:00", -10, 0.9), {"3:00", floatPtr(-20), floatPtr(0.5), false}}, nil, nil},
+    {"not analyzed", []albumLoudnessEntry{entry("3:00", -10, 0.9), {"3:00", nil, nil, true}}, nil, nil},
+    {"no songs", nil, nil, nil},
+  }
+  for _, test := range(tests) {
+    gain, peak := albumGain(test.entries)
+    if !closeGain(gain, test.gain) || !closeGain(peak, test.peak) {
+      t.Errorf("%s: got %s, %s, want %s, %s", test.name, formatGain(gain), formatGain(peak), formatGain(test.gain), formatGain(test.peak))
+    }
+  }
+}
+
+func closeGain(a, b *float64) bool {
+  if a == nil || b == nil {
+    return a == b
+  }
+  return math.Abs(*a - *b) < 1e-5
+}
+
+func formatGain(f *float64) string {
+  if f == nil {
+    return "nil"
+  }
+  return fmt.Sprintf("%.6f", *f)
+}
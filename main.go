@@ -1,6 +1,7 @@
 package main
 
 import (
+  "log"
   "os"
   "time"
   "github.com/urfave/cli/v2"
@@ -13,10 +14,7 @@ import (
 // Perhaps allow sublib by extension rather than flag, so don't need separate mp3 command.
 // Or simply use rclone/rsync for mp3.
 
-// TASKS: Add indexes to database, after populating it.  Use the log-level flag. Add a library
-// column to albums, and change configuration to support multiple libraries (one of which is the
-// default).  If library column is not used, then change database creation scripts to use a different
-// role for each database.
+// TASKS: Use the log-level flag.
 
 const verboseFlag = "verbose"
 
@@ -31,14 +29,21 @@ func main() {
       &cli.StringFlag {Name: "config", Required: true, EnvVars: []string{"MUSICLIB_CONFIG"},},
       &cli.BoolFlag {Name: verboseFlag, Aliases: []string{"v"}, Value: false, Destination: &verbose},
       &cli.StringFlag {Name: "log-level"},
+      &cli.StringFlag {Name: libraryFlag, Usage: "library to operate on, or 'all' for every library"},
     },
     Commands: []*cli.Command {
       &createCommand,
       &refreshCommand,
       &encodeCommand,
       &serveCommand,
+      &migrateCommand,
+      &loudnessCommand,
+      &playlistCommand,
+      &sublibCommand,
     },
     Before: Init,
   }
-  app.Run(os.Args)
+  if err := app.Run(os.Args); err != nil {
+    log.Fatalln(err)
+  }
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+  "database/sql"
+  "embed"
+  "fmt"
+  "io/fs"
+  "log"
+  "sort"
+  "strconv"
+  "github.com/urfave/cli/v2"
+  "github.com/brothertoad/btu"
+)
+
+// Migrations are SQL files named NNNN_description.sql, where NNNN is the
+// schema version the file brings the database up to.  The versions that
+// have been applied are recorded in the schema_version table.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+  version int
+  name string
+}
+
+var migrateCommand = cli.Command {
+  Name: "migrate",
+  Usage: "bring the database schema up to date",
+  Flags: []cli.Flag {
+    &cli.BoolFlag {Name: "status", Usage: "show the schema version without migrating"},
+  },
+  Action: doMigrate,
+}
+
+func doMigrate(c *cli.Context) error {
+  db := openDb()
+  defer db.Close()
+  if _, err := db.Exec("create table if not exists schema_version (version integer primary key, applied timestamptz default now())"); err != nil {
+    return err
+  }
+  current, err := getSchemaVersion(db)
+  if err != nil {
+    return err
+  }
+  migrations := loadMigrations()
+  latest := migrations[len(migrations) - 1].version
+  if c.Bool("status") {
+    fmt.Printf("Schema is at version %d, latest version is %d\n", current, latest)
+    return nil
+  }
+  for _, m := range(migrations) {
+    if m.version <= current {
+      continue
+    }
+    fmt.Printf("Applying migration %s...\n", m.name)
+    if err := applyMigration(db, m); err != nil {
+      return fmt.Errorf("migration %s failed: %w", m.name, err)
+    }
+  }
+  fmt.Printf("Schema is at version %d\n", latest)
+  return assignAlbumsToDefaultLibrary(db)
+}
+
+// Albums added before there were libraries don't have one, so they
+// belong to the default library.
+func assignAlbumsToDefaultLibrary(db *sql.DB) error {
+  lib := defaultLibrary()
+  if lib == nil {
+    return nil
+  }
+  result, err := db.Exec("update albums set library = $1 where library = ''", lib.Name)
+  if err != nil {
+    return err
+  }
+  if n, _ := result.RowsAffected(); n > 0 {
+    fmt.Printf("%d albums assigned to library %s\n", n, lib.Name)
+  }
+  return nil
+}
+
+// Apply a migration and record its version in a single transaction.
+func applyMigration(db *sql.DB, m migration) error {
+  b, err := migrationFiles.ReadFile("migrations/" + m.name)
+  if err != nil {
+    return err
+  }
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+  if _, err := tx.Exec(string(b)); err != nil {
+    return err
+  }
+  if _, err := tx.Exec("insert into schema_version(version) values ($1)", m.version); err != nil {
+    return err
+  }
+  return tx.Commit()
+}
+
+// Returns the embedded migrations, sorted by version.
+func loadMigrations() []migration {
+  entries, err := fs.ReadDir(migrationFiles, "migrations")
+  btu.CheckError(err)
+  migrations := make([]migration, 0, len(entries))
+  for _, entry := range(entries) {
+    name := entry.Name()
+    prefix, _, found := cutString(name, "_")
+    version, err := strconv.Atoi(prefix)
+    if !found || err != nil {
+      log.Fatalf("Migration '%s' does not start with a version number\n", name)
+    }
+    migrations = append(migrations, migration{version, name})
+  }
+  sort.Slice(migrations, func(i, j int) bool {
+    return migrations[i].version < migrations[j].version
+  })
+  return migrations
+}
+
+// Returns the version of the schema, which is zero if no migrations have been applied.
+func getSchemaVersion(db *sql.DB) (int, error) {
+  var exists bool
+  err := db.QueryRow("select to_regclass('schema_version') is not null").Scan(&exists)
+  if err != nil || !exists {
+    return 0, err
+  }
+  var version int
+  err = db.QueryRow("select coalesce(max(version), 0) from schema_version").Scan(&version)
+  return version, err
+}
+
+// Exit if the database schema doesn't match the migrations built into the program.
+func checkSchemaVersion(db *sql.DB) {
+  current, err := getSchemaVersion(db)
+  btu.CheckError(err)
+  migrations := loadMigrations()
+  latest := migrations[len(migrations) - 1].version
+  if current < latest {
+    log.Fatalf("Database schema is at version %d, but version %d is required; run 'musiclib migrate'.\n", current, latest)
+  }
+  if current > latest {
+    log.Fatalf("Database schema is at version %d, which is newer than this program (version %d).\n", current, latest)
+  }
+}
@@ -1,11 +1,14 @@
-create table artists (
+-- The original schema.  The tables may already exist if the database was
+-- created before migrations were introduced.
+
+create table if not exists artists (
 id int generated always as identity (start with 10001) primary key,
 name text,
 sort_name text,
 unique (name)
 );
 
-create table albums (
+create table if not exists albums (
 id int generated always as identity (start with 20001) primary key,
 artist integer references artists on delete cascade,
 title text,
@@ -13,7 +16,7 @@ sort_title text,
 unique (artist, title)
 );
 
-create table songs (
+create table if not exists songs (
 id int generated always as identity (start with 30001) primary key,
 album integer references albums on delete cascade,
 title text,
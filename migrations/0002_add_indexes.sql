@@ -0,0 +1,3 @@
+create index if not exists albums_artist_idx on albums (artist);
+create index if not exists songs_album_idx on songs (album);
+create index if not exists songs_size_and_time_idx on songs (size_and_time);
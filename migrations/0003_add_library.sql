@@ -0,0 +1,7 @@
+-- Albums belong to a library.  Albums that were added before there were
+-- libraries have an empty library, and the migrate command assigns them to
+-- the default library.
+alter table albums add column library text not null default '';
+alter table albums drop constraint if exists albums_artist_title_key;
+alter table albums add constraint albums_library_artist_title_key unique (library, artist, title);
+create index if not exists albums_library_idx on albums (library);
@@ -0,0 +1,8 @@
+-- Full text search vectors, used by the search endpoint.  The simple
+-- configuration is used because names and titles don't stem well.
+alter table artists add column search tsvector generated always as (to_tsvector('simple', coalesce(name, ''))) stored;
+alter table albums add column search tsvector generated always as (to_tsvector('simple', coalesce(title, ''))) stored;
+alter table songs add column search tsvector generated always as (to_tsvector('simple', coalesce(title, ''))) stored;
+create index artists_search_idx on artists using gin (search);
+create index albums_search_idx on albums using gin (search);
+create index songs_search_idx on songs using gin (search);
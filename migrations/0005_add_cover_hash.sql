@@ -0,0 +1,3 @@
+-- The sha256 hash of the album's art.  It is null if the album hasn't been
+-- checked for art yet, and empty if the album doesn't have any.
+alter table albums add column cover_hash text;
@@ -0,0 +1,16 @@
+-- Playlists, and the songs in them.  A song may appear in a playlist more
+-- than once, so entries are keyed by their position, which may have gaps.
+create table playlists (
+id int generated always as identity (start with 40001) primary key,
+name text not null,
+created timestamptz default now(),
+unique (name)
+);
+
+create table playlist_songs (
+playlist integer references playlists on delete cascade,
+position integer,
+song integer references songs on delete cascade,
+primary key (playlist, position)
+);
+create index playlist_songs_song_idx on playlist_songs (song);
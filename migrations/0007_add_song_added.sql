@@ -0,0 +1,3 @@
+-- When each song was added to the database.  Songs that were added before
+-- this column existed get the time of the migration.
+alter table songs add column added timestamptz not null default now();
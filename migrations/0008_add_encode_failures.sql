@@ -0,0 +1,10 @@
+-- Encodes that failed, with the end of the encoder's output.  A failure is
+-- removed when the song is encoded successfully by the same encoder.
+create table encode_failures (
+song integer references songs on delete cascade,
+encoder text,
+error text not null,
+stderr text not null default '',
+failed timestamptz not null default now(),
+primary key (song, encoder)
+);
@@ -0,0 +1,11 @@
+-- The size and time of each song when each encoder (identified by its
+-- extension) last encoded it.  This replaces songs.encoded_source, which
+-- encode only uses to avoid encoding songs again that were encoded before
+-- this table existed.
+create table song_encodings (
+song integer references songs on delete cascade,
+encoder text,
+source text not null,
+encoded timestamptz not null default now(),
+primary key (song, encoder)
+);
@@ -0,0 +1,14 @@
+-- The integrated loudness (in LUFS) and true peak (as a linear amplitude)
+-- of each song, and the ReplayGain 2.0 gain (in dB) that brings it to the
+-- reference of -18 LUFS.  loudness_source is the size and time of the song
+-- when it was analyzed, so songs that have changed since are analyzed again.
+-- The columns are null for songs that haven't been analyzed.
+alter table songs add column track_loudness double precision;
+alter table songs add column track_gain double precision;
+alter table songs add column track_peak double precision;
+alter table songs add column loudness_source text;
+
+-- The gain and peak of each album, from the loudness of all of its songs.
+-- They are null until every song of the album has been analyzed.
+alter table albums add column album_gain double precision;
+alter table albums add column album_peak double precision;
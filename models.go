@@ -17,9 +17,31 @@ type SongModel struct {
   Title string `json:"title"`
   Album string `json:"album"`
   Artist string `json:"artist"`
+  TrackGain *float64 `json:"trackGain,omitempty"`
+  TrackPeak *float64 `json:"trackPeak,omitempty"`
+  AlbumGain *float64 `json:"albumGain,omitempty"`
+  AlbumPeak *float64 `json:"albumPeak,omitempty"`
 }
 
 type UpdateSongStatesModel struct {
   State int `json:"state"`
   SongIds []int `json:"songIds"`
 }
+
+type SearchModel struct {
+  Artists []ArtistModel `json:"artists"`
+  Albums []AlbumModel `json:"albums"`
+  Songs []SongModel `json:"songs"`
+}
+
+type PlaylistModel struct {
+  Id int `json:"id"`
+  Name string `json:"name"`
+  SongCount int `json:"songCount"`
+  Songs []SongModel `json:"songs,omitempty"`
+}
+
+type UpdatePlaylistModel struct {
+  Name string `json:"name"`
+  SongIds []int `json:"songIds"`
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+  "database/sql"
+  "errors"
+  "net/http"
+  "strconv"
+  "strings"
+  "github.com/labstack/echo/v4"
+)
+
+// REST endpoints for playlists.  Playlists refer to songs by id, so they
+// survive songs being moved or retagged by refresh; a song that is deleted
+// is removed from any playlists it was in.
+
+func addPlaylistRoutes(e *echo.Echo, db *sql.DB) {
+  e.GET("/playlists", func(c echo.Context) error {
+    return getPlaylists(e, c, db)
+  })
+  e.POST("/playlists", func(c echo.Context) error {
+    return postPlaylist(e, c, db)
+  })
+  e.GET("/playlists/:playlistId", func(c echo.Context) error {
+    return getPlaylist(e, c, db)
+  })
+  e.PUT("/playlists/:playlistId", func(c echo.Context) error {
+    return putPlaylist(e, c, db)
+  })
+  e.DELETE("/playlists/:playlistId", func(c echo.Context) error {
+    return removePlaylist(e, c, db)
+  })
+  e.POST("/playlists/:playlistId/songs", func(c echo.Context) error {
+    return postPlaylistSongs(e, c, db)
+  })
+  e.PUT("/playlists/:playlistId/songs", func(c echo.Context) error {
+    return putPlaylistSongs(e, c, db)
+  })
+}
+
+func getPlaylists(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  playlists, err := loadPlaylists(db)
+  if err != nil {
+    e.Logger.Errorf("Error loading playlists: %s\n", err.Error())
+    return c.String(http.StatusInternalServerError, "Error loading playlists\n")
+  }
+  return c.JSON(http.StatusOK, playlists)
+}
+
+func getPlaylist(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  playlistId, ok := playlistIdParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "Can't convert playlistId to a number\n")
+  }
+  playlist, err := loadPlaylist(db, playlistId)
+  if err != nil {
+    return sendPlaylistError(e, c, playlistId, err)
+  }
+  return c.JSON(http.StatusOK, playlist)
+}
+
+// Create a playlist with the name and songs in the body, and return it.
+func postPlaylist(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  model, err := bindPlaylist(e, c, true)
+  if err != nil {
+    return c.String(http.StatusBadRequest, err.Error() + "\n")
+  }
+  playlistId, err := createPlaylist(db, model.Name, model.SongIds)
+  if err != nil {
+    return sendPlaylistError(e, c, 0, err)
+  }
+  playlist, err := loadPlaylist(db, playlistId)
+  if err != nil {
+    return sendPlaylistError(e, c, playlistId, err)
+  }
+  return c.JSON(http.StatusCreated, playlist)
+}
+
+// Rename a playlist.
+func putPlaylist(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  playlistId, ok := playlistIdParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "Can't convert playlistId to a number\n")
+  }
+  model, err := bindPlaylist(e, c, true)
+  if err != nil {
+    return c.String(http.StatusBadRequest, err.Error() + "\n")
+  }
+  if err := renamePlaylist(db, playlistId, model.Name); err != nil {
+    return sendPlaylistError(e, c, playlistId, err)
+  }
+  return c.String(http.StatusOK, "")
+}
+
+func removePlaylist(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  playlistId, ok := playlistIdParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "Can't convert playlistId to a number\n")
+  }
+  if err := deletePlaylist(db, playlistId); err != nil {
+    return sendPlaylistError(e, c, playlistId, err)
+  }
+  return c.String(http.StatusOK, "")
+}
+
+// Append the songs in the body to a playlist.
+func postPlaylistSongs(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  playlistId, ok := playlistIdParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "Can't convert playlistId to a number\n")
+  }
+  model, err := bindPlaylist(e, c, false)
+  if err != nil {
+    return c.String(http.StatusBadRequest, err.Error() + "\n")
+  }
+  if err := appendToPlaylist(db, playlistId, model.SongIds); err != nil {
+    return sendPlaylistError(e, c, playlistId, err)
+  }
+  return c.String(http.StatusOK, "")
+}
+
+// Replace the songs of a playlist with the songs in the body, in order.
+// This is how clients reorder or remove songs.
+func putPlaylistSongs(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  playlistId, ok := playlistIdParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "Can't convert playlistId to a number\n")
+  }
+  model, err := bindPlaylist(e, c, false)
+  if err != nil {
+    return c.String(http.StatusBadRequest, err.Error() + "\n")
+  }
+  if err := setPlaylistSongs(db, playlistId, model.SongIds); err != nil {
+    return sendPlaylistError(e, c, playlistId, err)
+  }
+  return c.String(http.StatusOK, "")
+}
+
+func playlistIdParam(e *echo.Echo, c echo.Context) (int, bool) {
+  playlistString := c.Param("playlistId")
+  playlistId, err := strconv.Atoi(playlistString)
+  if err != nil {
+    e.Logger.Errorf("Can't convert playlistId '%s' to a number\n", playlistString)
+    return 0, false
+  }
+  return playlistId, true
+}
+
+// Bind the body of a request.  The error describes what is wrong with the body.
+func bindPlaylist(e *echo.Echo, c echo.Context, needName bool) (*UpdatePlaylistModel, error) {
+  model := new(UpdatePlaylistModel)
+  if err := c.Bind(model); err != nil {
+    e.Logger.Errorf("Error binding body: %s\n", err.Error())
+    return nil, errors.New("Error binding body")
+  }
+  model.Name = strings.TrimSpace(model.Name)
+  if needName && model.Name == "" {
+    return nil, errors.New("Missing playlist name")
+  }
+  return model, nil
+}
+
+func sendPlaylistError(e *echo.Echo, c echo.Context, playlistId int, err error) error {
+  switch err {
+  case sql.ErrNoRows:
+    return c.String(http.StatusNotFound, "No such playlist\n")
+  case errPlaylistExists:
+    return c.String(http.StatusConflict, "A playlist with that name already exists\n")
+  case errUnknownSong:
+    return c.String(http.StatusBadRequest, "Unknown song\n")
+  }
+  e.Logger.Errorf("Error updating playlist %d: %s\n", playlistId, err.Error())
+  return c.String(http.StatusInternalServerError, "Error updating playlist\n")
+}
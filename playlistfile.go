@@ -0,0 +1,438 @@
+package main
+
+import (
+  "bufio"
+  "database/sql"
+  "fmt"
+  "io"
+  "net/url"
+  "os"
+  "path"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "unicode"
+  "github.com/urfave/cli/v2"
+)
+
+// Commands for importing playlists made by other players, and exporting
+// playlists for them.  M3U (including M3U8) and PLS files are supported.
+
+const nameFlag = "name"
+const replaceFlag = "replace"
+const encoderFlag = "encoder"
+const outputFlag = "output"
+const absoluteFlag = "absolute"
+const sublibFlag = "sublib"
+
+var playlistCommand = cli.Command {
+  Name: "playlist",
+  Usage: "import or export playlists",
+  Subcommands: []*cli.Command {
+    {
+      Name: "import",
+      Usage: "create playlists from M3U, M3U8 or PLS files",
+      ArgsUsage: "file...",
+      Flags: []cli.Flag {
+        &cli.StringFlag {Name: nameFlag, Usage: "name of the playlist (default is the name of the file)"},
+        &cli.BoolFlag {Name: replaceFlag, Usage: "replace the songs of a playlist that already exists"},
+        &cli.BoolFlag {Name: dryRunFlag, Aliases: []string{"n"}, Usage: "report what would be imported without importing it"},
+      },
+      Action: doPlaylistImport,
+    },
+    {
+      Name: "export",
+      Usage: "write a playlist to an M3U8 or PLS file",
+      ArgsUsage: "name",
+      Flags: []cli.Flag {
+        &cli.StringFlag {Name: formatFlag, Usage: "m3u8 or pls (default is from the output file's extension, or m3u8)"},
+        &cli.StringFlag {Name: encoderFlag, Usage: "extension of the encoder whose files the playlist refers to"},
+        &cli.StringFlag {Name: outputFlag, Aliases: []string{"o"}, Usage: "file to write (default is stdout)"},
+        &cli.BoolFlag {Name: absoluteFlag, Usage: "write absolute paths, rather than paths relative to the music or encoder directory"},
+        &cli.StringFlag {Name: sublibFlag, Usage: "only write the songs that are in this sublib"},
+      },
+      Action: doPlaylistExport,
+    },
+  },
+}
+
+// An entry in a playlist file.  The title and duration come from the
+// #EXTINF line of an M3U file, or the TitleN and LengthN keys of a PLS file,
+// and may be empty.
+type playlistFileEntry struct {
+  location string
+  title string
+  duration int
+}
+
+func doPlaylistImport(c *cli.Context) error {
+  if c.NArg() == 0 {
+    return fmt.Errorf("no playlist files given")
+  }
+  if c.NArg() > 1 && c.String(nameFlag) != "" {
+    return fmt.Errorf("--%s can only be used with a single file", nameFlag)
+  }
+  db := getDbConnection()
+  defer db.Close()
+  for _, lib := range(selectedLibraries) {
+    validateEncoders(lib)
+  }
+  candidates, err := loadPlaylistCandidates(db)
+  if err != nil {
+    return err
+  }
+  matcher := newPlaylistMatcher(candidates)
+  for _, fileName := range(c.Args().Slice()) {
+    name := c.String(nameFlag)
+    if name == "" {
+      name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+    }
+    if err := importPlaylist(c, db, matcher, fileName, name); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func importPlaylist(c *cli.Context, db *sql.DB, matcher *playlistMatcher, fileName, name string) error {
+  entries, err := readPlaylistFile(fileName)
+  if err != nil {
+    return err
+  }
+  playlistDir, err := filepath.Abs(filepath.Dir(fileName))
+  if err != nil {
+    return err
+  }
+  songIds := make([]int, 0, len(entries))
+  fuzzy := 0
+  for _, entry := range(entries) {
+    song, exact := matcher.match(entry, playlistDir)
+    if song == nil {
+      fmt.Printf("%s: no match for '%s'\n", name, entry.location)
+      continue
+    }
+    if !exact {
+      fuzzy++
+      if verbose {
+        fmt.Printf("%s: matched '%s' to '%s' by its tags\n", name, entry.location, song.RelativePath)
+      }
+    }
+    songIds = append(songIds, song.Id)
+  }
+  fmt.Printf("%s: matched %d of %d entries, %d of them by their tags\n", name, len(songIds), len(entries), fuzzy)
+  if c.Bool(dryRunFlag) {
+    return nil
+  }
+  playlistId, err := loadPlaylistId(db, name)
+  if err == sql.ErrNoRows {
+    _, err = createPlaylist(db, name, songIds)
+    return err
+  }
+  if err != nil {
+    return err
+  }
+  if !c.Bool(replaceFlag) {
+    return fmt.Errorf("playlist '%s' already exists; use --%s to replace its songs", name, replaceFlag)
+  }
+  return setPlaylistSongs(db, playlistId, songIds)
+}
+
+func readPlaylistFile(fileName string) ([]playlistFileEntry, error) {
+  f, err := os.Open(fileName)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  if strings.EqualFold(filepath.Ext(fileName), ".pls") {
+    return readPls(f)
+  }
+  return readM3u(f)
+}
+
+func readM3u(r io.Reader) ([]playlistFileEntry, error) {
+  entries := make([]playlistFileEntry, 0)
+  var info playlistFileEntry
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+    if strings.HasPrefix(line, "#EXTINF:") {
+      // #EXTINF:duration,title - the duration may be followed by attributes.
+      durationAndAttributes, title, _ := cutString(strings.TrimPrefix(line, "#EXTINF:"), ",")
+      info = playlistFileEntry{title: strings.TrimSpace(title)}
+      if fields := strings.Fields(durationAndAttributes); len(fields) > 0 {
+        info.duration, _ = strconv.Atoi(fields[0])
+      }
+      continue
+    }
+    if line == "" || strings.HasPrefix(line, "#") {
+      continue
+    }
+    info.location = line
+    entries = append(entries, info)
+    info = playlistFileEntry{}
+  }
+  return entries, scanner.Err()
+}
+
+func readPls(r io.Reader) ([]playlistFileEntry, error) {
+  byNumber := make(map[int]*playlistFileEntry)
+  numbers := make([]int, 0)
+  scanner := bufio.NewScanner(r)
+  for scanner.Scan() {
+    key, value, found := cutString(strings.TrimSpace(scanner.Text()), "=")
+    if !found {
+      continue
+    }
+    var field string
+    for _, prefix := range([]string{"File", "Title", "Length"}) {
+      if strings.HasPrefix(key, prefix) {
+        field = prefix
+      }
+    }
+    n, err := strconv.Atoi(strings.TrimPrefix(key, field))
+    if field == "" || err != nil {
+      continue
+    }
+    entry, present := byNumber[n]
+    if !present {
+      entry = &playlistFileEntry{}
+      byNumber[n] = entry
+      numbers = append(numbers, n)
+    }
+    switch field {
+    case "File":
+      entry.location = value
+    case "Title":
+      entry.title = value
+    case "Length":
+      entry.duration, _ = strconv.Atoi(value)
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, err
+  }
+  sort.Ints(numbers)
+  entries := make([]playlistFileEntry, 0, len(numbers))
+  for _, n := range(numbers) {
+    if byNumber[n].location != "" {
+      entries = append(entries, *byNumber[n])
+    }
+  }
+  return entries, nil
+}
+
+// Matches entries of playlist files to songs.  An entry is matched by its
+// path first, which may be in the music directory of a selected library or
+// in the directory of one of its encoders.  If that fails, the entry is
+// matched by the artist, album and title in its #EXTINF line or its path.
+type playlistMatcher struct {
+  byPath map[string]*playlistSong
+  byBasePath map[string]*playlistSong
+  byTags map[string][]*playlistSong
+}
+
+func newPlaylistMatcher(songs []playlistSong) *playlistMatcher {
+  m := &playlistMatcher{make(map[string]*playlistSong), make(map[string]*playlistSong), make(map[string][]*playlistSong)}
+  for i := range(songs) {
+    song := &songs[i]
+    // The paths of songs start with a slash, which the paths they are looked
+    // up by don't have.
+    m.byPath[song.Library + "/" + strings.TrimPrefix(song.RelativePath, "/")] = song
+    m.byBasePath[song.Library + "/" + strings.TrimPrefix(song.BasePath, "/")] = song
+    m.byTags[tagKey(song.Artist, song.Album, song.Title)] = append(m.byTags[tagKey(song.Artist, song.Album, song.Title)], song)
+    m.byTags[tagKey(song.Artist, "", song.Title)] = append(m.byTags[tagKey(song.Artist, "", song.Title)], song)
+  }
+  return m
+}
+
+// Returns the song an entry refers to, or nil, and whether it was matched by
+// its path.
+func (m *playlistMatcher) match(entry playlistFileEntry, playlistDir string) (*playlistSong, bool) {
+  location := entry.location
+  if u, err := url.Parse(location); err == nil && u.Scheme == "file" {
+    location = u.Path
+  }
+  location = filepath.FromSlash(strings.ReplaceAll(location, "\\", "/"))
+  locations := []string{location}
+  if !filepath.IsAbs(location) {
+    locations = append(locations, filepath.Join(playlistDir, location))
+  }
+  for _, lib := range(selectedLibraries) {
+    for _, loc := range(locations) {
+      if song := m.matchPath(lib, loc); song != nil {
+        return song, true
+      }
+    }
+  }
+  // Fall back to the tags.  The title of the entry is usually "artist - title",
+  // and its path is usually artist/album/track title.extension.
+  dir, file := path.Split(filepath.ToSlash(location))
+  album := path.Base(dir)
+  artist := path.Base(path.Dir(strings.TrimSuffix(dir, "/")))
+  title := trackNumberPattern.ReplaceAllString(strings.TrimSuffix(file, path.Ext(file)), "")
+  keys := []string{tagKey(artist, album, title), tagKey(artist, "", title)}
+  if extArtist, extTitle, found := cutString(entry.title, " - "); found {
+    keys = append([]string{tagKey(extArtist, album, extTitle), tagKey(extArtist, "", extTitle)}, keys...)
+  }
+  for _, key := range(keys) {
+    // Only use a match if it is the only one.
+    if songs := m.byTags[key]; len(songs) == 1 {
+      return songs[0], false
+    }
+  }
+  return nil, false
+}
+
+// Match a path against the songs of a library, either as a path relative to
+// its music directory, or in its music directory or one of its encoder
+// directories.
+func (m *playlistMatcher) matchPath(lib *LibraryInfo, location string) *playlistSong {
+  if !filepath.IsAbs(location) {
+    return m.byPath[lib.Name + "/" + strings.TrimPrefix(filepath.ToSlash(location), "/")]
+  }
+  if rel, err := filepath.Rel(lib.MusicDir, location); err == nil && !strings.HasPrefix(rel, "..") {
+    if song := m.byPath[lib.Name + "/" + filepath.ToSlash(rel)]; song != nil {
+      return song
+    }
+  }
+  for _, encoder := range(lib.Encoders) {
+    if rel, err := filepath.Rel(encoder.Directory, location); err == nil && !strings.HasPrefix(rel, "..") {
+      rel = filepath.ToSlash(rel)
+      if song := m.byBasePath[lib.Name + "/" + strings.TrimSuffix(rel, path.Ext(rel))]; song != nil {
+        return song
+      }
+    }
+  }
+  return nil
+}
+
+// Matches the track and disc number at the start of a file name.
+var trackNumberPattern = regexp.MustCompile(`^\d+([-.]\d+)?[\s.\-_]*`)
+
+// Returns a key for matching songs by their tags, which ignores case,
+// punctuation and spacing.
+func tagKey(artist, album, title string) string {
+  normalize := func(s string) string {
+    return strings.Map(func(r rune) rune {
+      if unicode.IsLetter(r) || unicode.IsNumber(r) {
+        return unicode.ToLower(r)
+      }
+      return -1
+    }, s)
+  }
+  return normalize(artist) + "|" + normalize(album) + "|" + normalize(title)
+}
+
+func doPlaylistExport(c *cli.Context) error {
+  if c.NArg() != 1 {
+    return fmt.Errorf("expected the name of one playlist")
+  }
+  name := c.Args().First()
+  format := c.String(formatFlag)
+  if format == "" {
+    format = "m3u8"
+    if strings.EqualFold(filepath.Ext(c.String(outputFlag)), ".pls") {
+      format = "pls"
+    }
+  }
+  if format != "m3u8" && format != "m3u" && format != "pls" {
+    return fmt.Errorf("unknown playlist format '%s'", format)
+  }
+  sublib := c.String(sublibFlag)
+  if sublib != "" && findSublib(sublib) == nil {
+    return fmt.Errorf("no sublib named '%s' in the selected libraries", sublib)
+  }
+  db := getDbConnection()
+  defer db.Close()
+  for _, lib := range(selectedLibraries) {
+    validateEncoders(lib)
+  }
+  playlistId, err := loadPlaylistId(db, name)
+  if err == sql.ErrNoRows {
+    return fmt.Errorf("no playlist named '%s'", name)
+  }
+  if err != nil {
+    return err
+  }
+  songs, err := loadPlaylistEntries(db, playlistId)
+  if err != nil {
+    return err
+  }
+  entries := make([]playlistFileEntry, 0, len(songs))
+  for _, song := range(songs) {
+    if sublib != "" && !containsString(strings.Split(song.Sublibs, ","), sublib) {
+      continue
+    }
+    location, err := exportPath(song, c.String(encoderFlag), c.Bool(absoluteFlag))
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "Skipping '%s': %s\n", song.RelativePath, err.Error())
+      continue
+    }
+    entries = append(entries, playlistFileEntry{location, song.Artist + " - " + song.Title, durationSeconds(song.Duration)})
+  }
+
+  var w io.Writer = os.Stdout
+  if c.String(outputFlag) != "" {
+    f, err := os.Create(c.String(outputFlag))
+    if err != nil {
+      return err
+    }
+    defer f.Close()
+    w = f
+  }
+  bw := bufio.NewWriter(w)
+  if format == "pls" {
+    writePls(bw, entries)
+  } else {
+    writeM3u(bw, entries)
+  }
+  return bw.Flush()
+}
+
+// Returns the path to write in a playlist for a song.  The path is relative to
+// the music directory of the song's library, or to the directory of the
+// encoder with the given extension if there is one, unless absolute is true.
+func exportPath(song playlistSong, encoderExtension string, absolute bool) (string, error) {
+  lib := findSelectedLibrary(song.Library)
+  if lib == nil {
+    return "", fmt.Errorf("library %s is not selected", song.Library)
+  }
+  filePath, _, err := songFilePath(lib, song.Song, encoderExtension)
+  if err != nil {
+    return "", err
+  }
+  if absolute {
+    return filePath, nil
+  }
+  if encoderExtension == "" {
+    return strings.TrimPrefix(song.RelativePath, "/"), nil
+  }
+  for _, encoder := range(lib.Encoders) {
+    if encoder.Extension == encoderExtension {
+      rel, err := filepath.Rel(encoder.Directory, filePath)
+      return filepath.ToSlash(rel), err
+    }
+  }
+  return filePath, nil
+}
+
+func writeM3u(w io.Writer, entries []playlistFileEntry) {
+  fmt.Fprintln(w, "#EXTM3U")
+  for _, entry := range(entries) {
+    fmt.Fprintf(w, "#EXTINF:%d,%s\n", entry.duration, entry.title)
+    fmt.Fprintln(w, entry.location)
+  }
+}
+
+func writePls(w io.Writer, entries []playlistFileEntry) {
+  fmt.Fprintln(w, "[playlist]")
+  for i, entry := range(entries) {
+    fmt.Fprintf(w, "File%d=%s\n", i + 1, entry.location)
+    fmt.Fprintf(w, "Title%d=%s\n", i + 1, entry.title)
+    fmt.Fprintf(w, "Length%d=%d\n", i + 1, entry.duration)
+  }
+  fmt.Fprintf(w, "NumberOfEntries=%d\n", len(entries))
+  fmt.Fprintln(w, "Version=2")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestReadM3u(t *testing.T) {
+  tests := []struct {
+    name string
+    input string
+    want []playlistFileEntry
+  }{
+    {"plain", "a/one.mp3\n\nb/two.flac\n", []playlistFileEntry{{"a/one.mp3", "", 0}, {"b/two.flac", "", 0}}},
+    {"extended", "#EXTM3U\n#EXTINF:215,Miles Davis - So What\n/music/so what.flac\n#EXTINF:-1,Stream\nhttp://example.com/stream\n",
+      []playlistFileEntry{{"/music/so what.flac", "Miles Davis - So What", 215}, {"http://example.com/stream", "Stream", -1}}},
+    {"attributes", "#EXTM3U\n#EXTINF:180 tvg-id=\"x\",Title, with comma\nsong.mp3\n", []playlistFileEntry{{"song.mp3", "Title, with comma", 180}}},
+    {"info only applies to the next entry", "#EXTINF:100,First\none.mp3\ntwo.mp3\n", []playlistFileEntry{{"one.mp3", "First", 100}, {"two.mp3", "", 0}}},
+    {"byte order mark and crlf", "\ufeff#EXTM3U\r\n#EXTINF:60,Song\r\nsong.mp3\r\n", []playlistFileEntry{{"song.mp3", "Song", 60}}},
+    {"comments", "# a comment\n#EXTVLCOPT:foo\nsong.mp3\n", []playlistFileEntry{{"song.mp3", "", 0}}},
+    {"empty", "", []playlistFileEntry{}},
+  }
+  for _, test := range(tests) {
+    got, err := readM3u(strings.NewReader(test.input))
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    if !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestReadPls(t *testing.T) {
+  tests := []struct {
+    name string
+    input string
+    want []playlistFileEntry
+  }{
+    {"ordered", "[playlist]\nFile1=one.mp3\nTitle1=One\nLength1=100\nFile2=two.flac\nTitle2=Two\nLength2=-1\nNumberOfEntries=2\nVersion=2\n",
+      []playlistFileEntry{{"one.mp3", "One", 100}, {"two.flac", "Two", -1}}},
+    {"out of order", "[playlist]\nFile10=ten.mp3\nTitle2=Two\nFile2=two.mp3\nFile1=one.mp3\n",
+      []playlistFileEntry{{"one.mp3", "", 0}, {"two.mp3", "Two", 0}, {"ten.mp3", "", 0}}},
+    {"no file", "[playlist]\nTitle1=Missing\nFile2=two.mp3\n", []playlistFileEntry{{"two.mp3", "", 0}}},
+    {"equals in value", "[playlist]\nFile1=http://example.com/?a=b\n", []playlistFileEntry{{"http://example.com/?a=b", "", 0}}},
+    {"junk", "[playlist]\nFileX=bad.mp3\nnot a setting\n", []playlistFileEntry{}},
+  }
+  for _, test := range(tests) {
+    got, err := readPls(strings.NewReader(test.input))
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    if !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestPlaylistMatcher(t *testing.T) {
+  saved := selectedLibraries
+  t.Cleanup(func() { selectedLibraries = saved })
+  selectedLibraries = []*LibraryInfo{{
+    Name: "main",
+    MusicDir: "/music",
+    Encoders: []EncoderInfo{{Extension: ".mp3", Directory: "/mp3"}},
+  }}
+  songs := []playlistSong{
+    {Song{Id: 1, Title: "So What", RelativePath: "/Miles Davis/Kind of Blue/01 So What.flac", BasePath: "/Miles Davis/Kind of Blue/01 So What"}, "Kind of Blue", "Miles Davis", "main"},
+    {Song{Id: 2, Title: "Freddie Freeloader", RelativePath: "/Miles Davis/Kind of Blue/02 Freddie Freeloader.flac", BasePath: "/Miles Davis/Kind of Blue/02 Freddie Freeloader"}, "Kind of Blue", "Miles Davis", "main"},
+  }
+  matcher := newPlaylistMatcher(songs)
+  tests := []struct {
+    name string
+    entry playlistFileEntry
+    playlistDir string
+    wantId int
+    wantByPath bool
+  }{
+    {"relative to the music directory", playlistFileEntry{location: "Miles Davis/Kind of Blue/01 So What.flac"}, "/playlists", 1, true},
+    {"relative to the playlist", playlistFileEntry{location: "../music/Miles Davis/Kind of Blue/02 Freddie Freeloader.flac"}, "/playlists", 2, true},
+    {"absolute", playlistFileEntry{location: "/music/Miles Davis/Kind of Blue/01 So What.flac"}, "/playlists", 1, true},
+    {"file url", playlistFileEntry{location: "file:///music/Miles%20Davis/Kind%20of%20Blue/01%20So%20What.flac"}, "/playlists", 1, true},
+    {"encoder output", playlistFileEntry{location: "/mp3/Miles Davis/Kind of Blue/02 Freddie Freeloader.mp3"}, "/playlists", 2, true},
+    {"windows separators", playlistFileEntry{location: "Miles Davis\\Kind of Blue\\01 So What.flac"}, "/playlists", 1, true},
+    {"title", playlistFileEntry{location: "/elsewhere/song.mp3", title: "Miles Davis - So What"}, "/playlists", 1, false},
+    {"path tags", playlistFileEntry{location: "/elsewhere/Miles Davis/Kind of Blue/02 - Freddie Freeloader.ogg"}, "/playlists", 2, false},
+    {"unknown", playlistFileEntry{location: "/elsewhere/song.mp3", title: "Someone - Something"}, "/playlists", 0, false},
+  }
+  for _, test := range(tests) {
+    song, byPath := matcher.match(test.entry, test.playlistDir)
+    id := 0
+    if song != nil {
+      id = song.Id
+    }
+    if id != test.wantId || byPath != test.wantByPath {
+      t.Errorf("%s: got song %d (by path %v), want %d (by path %v)", test.name, id, byPath, test.wantId, test.wantByPath)
+    }
+  }
+}
@@ -3,50 +3,73 @@ package main
 import (
   "database/sql"
   "fmt"
+  "os"
+  "runtime"
   "time"
   "github.com/urfave/cli/v2"
-  "github.com/brothertoad/btu"
   "github.com/brothertoad/tags"
 )
 
 var useMd5 = false
+var incremental = false
+var recheckCovers = false
+
+const formatFlag = "format"
 
 var refreshCommand = cli.Command {
   Name: "refresh",
 	Flags: []cli.Flag {
 	  &cli.BoolFlag {Name: "md5", Aliases: []string{"m"}, Value: false, Destination: &useMd5},
+	  &cli.BoolFlag {Name: "incremental", Aliases: []string{"i"}, Value: false, Destination: &incremental,
+	    Usage: "only read the tags of files whose size or modification time changed"},
+	  &cli.IntFlag {Name: jobsFlag, Aliases: []string{"j"}, Value: runtime.NumCPU(), Usage: "number of files to scan concurrently"},
+	  &cli.BoolFlag {Name: dryRunFlag, Aliases: []string{"n"}, Usage: "report what would change without updating the database"},
+	  &cli.StringFlag {Name: formatFlag, Value: "text", Usage: "format of the dry run report (text or json)"},
+	  &cli.BoolFlag {Name: "covers", Value: false, Destination: &recheckCovers, Usage: "look for art for every album, not just new ones"},
 	},
   Usage: "refresh the database",
   Action: doRefresh,
 }
 
 func doRefresh(c *cli.Context) error {
+  if format := c.String(formatFlag); format != "text" && format != "json" {
+    return fmt.Errorf("unknown report format '%s'", format)
+  }
   db := getDbConnection()
   defer db.Close()
+  return forEachLibrary(func() error {
+    return refreshLibrary(c, db)
+  })
+}
+
+func refreshLibrary(c *cli.Context, db *sql.DB) error {
   t0 := time.Now()
-  if verbose {
-	  fmt.Printf("About to load songs from disk %s\n", time.Now().Format(time.TimeOnly))
-  }
-  diskSongMaps := loadSongMapSliceFromMusicDir(useMd5)
   if verbose {
 	  fmt.Printf("About to load songs from database %s\n", time.Now().Format(time.TimeOnly))
   }
   dbSongMaps := artistMapToSongMaps(readArtistMapFromDb(db))
-  if verbose {
-	  fmt.Printf("About to convert keys from disk songs %s\n", time.Now().Format(time.TimeOnly))
-  }
-  diskKeys := songMapSliceToSizeAndTimeMap(diskSongMaps)
   if verbose {
 	  fmt.Printf("About to convert keys from database songs %s\n", time.Now().Format(time.TimeOnly))
   }
   dbKeys := songMapSliceToSizeAndTimeMap(dbSongMaps)
+  // In incremental mode, files whose size and time match a song in the
+  // database are not opened.
+  var known map[string]tags.TagMap
+  if incremental {
+    known = dbKeys
+  }
+  if verbose {
+	  fmt.Printf("About to load songs from disk %s\n", time.Now().Format(time.TimeOnly))
+  }
+  diskSongMaps := loadSongMapSliceFromMusicDir(useMd5, c.Int(jobsFlag), known)
   if verbose {
-	  fmt.Printf("About to calculate the number of songs that moved %s\n", time.Now().Format(time.TimeOnly))
+	  fmt.Printf("About to convert keys from disk songs %s\n", time.Now().Format(time.TimeOnly))
   }
-  numMoved := updatePaths(db, dbKeys, diskKeys)
-  if numMoved > 0 {
-    fmt.Printf("%d songs moved\n", numMoved)
+  diskKeys := songMapSliceToSizeAndTimeMap(diskSongMaps)
+  if verbose {
+	  fmt.Printf("About to find moved %s\n", time.Now().Format(time.TimeOnly))
   }
+  moved := findMoved(dbKeys, diskKeys)
   if verbose {
 	  fmt.Printf("About to find added %s\n", time.Now().Format(time.TimeOnly))
   }
@@ -55,22 +78,85 @@ func doRefresh(c *cli.Context) error {
 	  fmt.Printf("About to find deleted %s\n", time.Now().Format(time.TimeOnly))
   }
   deleted := findMissing(dbKeys, diskKeys)
-  fmt.Printf("%d songs added, %d songs deleted\n", len(added), len(deleted))
+  if verbose {
+	  fmt.Printf("About to find modified %s\n", time.Now().Format(time.TimeOnly))
+  }
+  modified := findModified(added, deleted)
+  // If this is a dry run, report the changes and leave the database alone.
+  if c.Bool(dryRunFlag) {
+    report := makeRefreshReport(moved, added, deleted, modified)
+    return report.print(os.Stdout, c.String(formatFlag))
+  }
+  if len(moved) > 0 {
+    fmt.Printf("%d songs moved\n", len(moved))
+  }
+  fmt.Printf("%d songs added, %d songs deleted, %d songs modified\n", len(added), len(deleted), len(modified))
+  // Everything from here on is done in a single transaction, so a failure
+  // leaves the database as it was before the refresh.
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  // Rollback does nothing if the transaction has been committed.
+  defer tx.Rollback()
+  if verbose {
+	  fmt.Printf("About to update paths of moved songs %s\n", time.Now().Format(time.TimeOnly))
+  }
+  if err := updatePaths(tx, moved); err != nil {
+    return err
+  }
   if verbose {
 	  fmt.Printf("About to delete songs from database %s\n", time.Now().Format(time.TimeOnly))
   }
-  deleteSongsFromDb(db, deleted)
+  if err := deleteSongsFromDb(tx, deleted); err != nil {
+    return err
+  }
   if verbose {
 	  fmt.Printf("About to add songs to database %s\n", time.Now().Format(time.TimeOnly))
   }
-  addSongsToDb(db, added)
+  if err := addSongsToDb(tx, added); err != nil {
+    return err
+  }
+  if verbose {
+	  fmt.Printf("About to update modified songs in database %s\n", time.Now().Format(time.TimeOnly))
+  }
+  if err := updateSongsInDb(tx, modified); err != nil {
+    return err
+  }
   if verbose {
 	  fmt.Printf("About to delete empty containers in database %s\n", time.Now().Format(time.TimeOnly))
   }
-  deleteEmptyContainers(db)
+  numAlbums, numArtists, err := deleteEmptyContainers(tx)
+  if err != nil {
+    return err
+  }
   if verbose {
 	  fmt.Printf("Done deleting empty containers in database %s\n", time.Now().Format(time.TimeOnly))
   }
+  if err := tx.Commit(); err != nil {
+    return err
+  }
+  if numAlbums > 0 || numArtists > 0 {
+    fmt.Printf("%d empty albums deleted, %d empty artists deleted\n", numAlbums, numArtists)
+  }
+  // Finding art isn't part of the transaction, as it doesn't need to be
+  // consistent with the songs, and an album is simply checked again if
+  // finding its art fails.
+  if verbose {
+	  fmt.Printf("About to find album art %s\n", time.Now().Format(time.TimeOnly))
+  }
+  if err := findAlbumCovers(db, recheckCovers); err != nil {
+    return err
+  }
+  // Songs that were added or changed may have joined or left sublibs.
+  if len(library.Sublibs) > 0 {
+    if verbose {
+	    fmt.Printf("About to update sublib membership %s\n", time.Now().Format(time.TimeOnly))
+    }
+    if _, _, err := updateSublibMembership(db, false); err != nil {
+      return err
+    }
+  }
   t1 := time.Now()
   elapsed := t1.Sub(t0) // elapsed is nanoseconds
   seconds := (elapsed + 500000000) / 1000000000
@@ -99,21 +185,58 @@ func findMissing(src, dest map[string]tags.TagMap) map[string]tags.TagMap {
   return list
 }
 
-func updatePaths(db *sql.DB, stale, fresh map[string]tags.TagMap) int {
-    total := 0
-    for k, v := range fresh {
-      ov, found := stale[k]
-      if !found {
-        continue // ignore fresh songs that aren't in stale
-      }
-      freshPath := v[tags.RelativePathKey]
-      stalePath := ov[tags.RelativePathKey]
-      if freshPath != stalePath {
-        // Note that since the fresh map was read from disk, there are no ids.
-        id := btu.Atoi2(ov[tags.IdKey], "Can't convert '%s' to a song id", ov[tags.IdKey])
-        updateSongPaths(db, id, v)
-        total++
-      }
+// A song that was added and deleted at the same relative path is really a
+// song whose tags were edited.  Such songs are removed from the added and
+// deleted maps and returned.
+func findModified(added, deleted map[string]tags.TagMap) []songMove {
+  deletedPaths := make(map[string]string, len(deleted))
+  for sizeAndTime, songMap := range(deleted) {
+    deletedPaths[songMap[tags.RelativePathKey]] = sizeAndTime
+  }
+  modified := make([]songMove, 0)
+  for addedSizeAndTime, addedSongMap := range(added) {
+    deletedSizeAndTime, present := deletedPaths[addedSongMap[tags.RelativePathKey]]
+    if !present {
+      continue
+    }
+    modified = append(modified, songMove{deleted[deletedSizeAndTime], addedSongMap})
+    delete(added, addedSizeAndTime)
+    delete(deleted, deletedSizeAndTime)
+  }
+  return modified
+}
+
+// A song that is in the database, but whose file has moved or been retagged.
+type songMove struct {
+  stale tags.TagMap
+  fresh tags.TagMap
+}
+
+// Find the songs whose size and time didn't change, but whose path did.
+func findMoved(stale, fresh map[string]tags.TagMap) []songMove {
+  moved := make([]songMove, 0)
+  for k, v := range fresh {
+    ov, found := stale[k]
+    if !found {
+      continue // ignore fresh songs that aren't in stale
+    }
+    if v[tags.RelativePathKey] != ov[tags.RelativePathKey] {
+      moved = append(moved, songMove{ov, v})
+    }
+  }
+  return moved
+}
+
+func updatePaths(tx *sql.Tx, moved []songMove) error {
+  for _, move := range(moved) {
+    // Note that since the fresh map was read from disk, there are no ids.
+    id, err := songMapId(move.stale)
+    if err != nil {
+      return err
     }
-    return total
+    if err := updateSongPaths(tx, id, move.fresh); err != nil {
+      return err
+    }
+  }
+  return nil
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "sort"
+  "strconv"
+  "github.com/brothertoad/tags"
+)
+
+// A description of the changes a refresh would make, used by refresh --dry-run.
+
+type refreshSummary struct {
+  Moved int `json:"moved"`
+  Added int `json:"added"`
+  Deleted int `json:"deleted"`
+  Modified int `json:"modified"`
+}
+
+type songChange struct {
+  Change string `json:"change"`
+  Artist string `json:"artist"`
+  Album string `json:"album"`
+  Title string `json:"title"`
+  DiscNum int `json:"discNum"`
+  TrackNum int `json:"trackNum"`
+  Path string `json:"path"`
+  OldPath string `json:"oldPath,omitempty"`
+  OldArtist string `json:"oldArtist,omitempty"`
+  OldAlbum string `json:"oldAlbum,omitempty"`
+  OldTitle string `json:"oldTitle,omitempty"`
+}
+
+type refreshReport struct {
+  Summary refreshSummary `json:"summary"`
+  Changes []songChange `json:"changes"`
+}
+
+func makeRefreshReport(moved []songMove, added, deleted map[string]tags.TagMap, modified []songMove) refreshReport {
+  var report refreshReport
+  report.Summary = refreshSummary{len(moved), len(added), len(deleted), len(modified)}
+  report.Changes = make([]songChange, 0, len(moved) + len(added) + len(deleted) + len(modified))
+  for _, move := range(moved) {
+    change := makeSongChange("moved", move.fresh)
+    change.OldPath = move.stale[tags.RelativePathKey]
+    report.Changes = append(report.Changes, change)
+  }
+  for _, songMap := range(added) {
+    report.Changes = append(report.Changes, makeSongChange("added", songMap))
+  }
+  for _, songMap := range(deleted) {
+    report.Changes = append(report.Changes, makeSongChange("deleted", songMap))
+  }
+  for _, move := range(modified) {
+    change := makeSongChange("modified", move.fresh)
+    change.OldArtist = changedValue(move, tags.ArtistKey)
+    change.OldAlbum = changedValue(move, tags.AlbumKey)
+    change.OldTitle = changedValue(move, tags.TitleKey)
+    report.Changes = append(report.Changes, change)
+  }
+  sort.Slice(report.Changes, func(i, j int) bool {
+    a, b := report.Changes[i], report.Changes[j]
+    if a.Artist != b.Artist {
+      return a.Artist < b.Artist
+    }
+    if a.Album != b.Album {
+      return a.Album < b.Album
+    }
+    if a.DiscNum != b.DiscNum {
+      return a.DiscNum < b.DiscNum
+    }
+    if a.TrackNum != b.TrackNum {
+      return a.TrackNum < b.TrackNum
+    }
+    return a.Path < b.Path
+  })
+  return report
+}
+
+func makeSongChange(change string, songMap tags.TagMap) songChange {
+  // Tags aren't always numbers, so ignore conversion errors.
+  discNum, _ := strconv.Atoi(songMap[tags.DiscNumberKey])
+  trackNum, _ := strconv.Atoi(songMap[tags.TrackNumberKey])
+  return songChange{
+    Change: change,
+    Artist: songMap[tags.ArtistKey],
+    Album: songMap[tags.AlbumKey],
+    Title: songMap[tags.TitleKey],
+    DiscNum: discNum,
+    TrackNum: trackNum,
+    Path: songMap[tags.RelativePathKey],
+  }
+}
+
+// Returns the stale value of a tag if it changed, or an empty string if it didn't.
+func changedValue(move songMove, key string) string {
+  if move.stale[key] == move.fresh[key] {
+    return ""
+  }
+  return move.stale[key]
+}
+
+func (report refreshReport) print(w io.Writer, format string) error {
+  switch format {
+  case "json":
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(report)
+  case "text", "":
+    report.printText(w)
+    return nil
+  }
+  return fmt.Errorf("unknown report format '%s'", format)
+}
+
+func (report refreshReport) printText(w io.Writer) {
+  artist := ""
+  album := ""
+  for n, change := range(report.Changes) {
+    newArtist := n == 0 || change.Artist != artist
+    if newArtist {
+      artist = change.Artist
+      fmt.Fprintf(w, "%s\n", artist)
+    }
+    if newArtist || change.Album != album {
+      album = change.Album
+      fmt.Fprintf(w, "  %s\n", album)
+    }
+    fmt.Fprintf(w, "    %-8s %d-%02d %s", change.Change, change.DiscNum, change.TrackNum, change.Title)
+    if change.OldPath != "" {
+      fmt.Fprintf(w, " (%s -> %s)", change.OldPath, change.Path)
+    } else {
+      fmt.Fprintf(w, " (%s)", change.Path)
+    }
+    for _, old := range([][2]string{{"title", change.OldTitle}, {"album", change.OldAlbum}, {"artist", change.OldArtist}}) {
+      if old[1] != "" {
+        fmt.Fprintf(w, " [%s was '%s']", old[0], old[1])
+      }
+    }
+    fmt.Fprintln(w)
+  }
+  s := report.Summary
+  fmt.Fprintf(w, "%d songs would be moved, %d added, %d deleted, %d modified\n", s.Moved, s.Added, s.Deleted, s.Modified)
+}
@@ -9,4 +9,4 @@ SCRIPTDIR=`dirname -- "$( readlink -f -- "$0"; )"`
 
 psql --user postgres --set=MUSICDB=$MUSICDB -f $SCRIPTDIR/delete_db.sql
 psql --user postgres --set=MUSICDB=$MUSICDB -f $SCRIPTDIR/create_db.sql
-psql --user musiclib -f $SCRIPTDIR/create_tables.sql -d $MUSICDB
+echo "Database $MUSICDB created; run 'musiclib migrate' to create the tables."
@@ -25,6 +25,11 @@ func doServe(c *cli.Context) error {
   db := getDbConnection()
 	defer db.Close()
 
+  for _, lib := range(selectedLibraries) {
+    validateEncoders(lib)
+  }
+  validateTranscoders()
+
 	e := echo.New()
   e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
     Format: "${time_rfc3339} ${method} uri=${uri} status=${status} error=${error}\n",
@@ -49,6 +54,22 @@ func doServe(c *cli.Context) error {
   e.POST("/updatesongs", func(c echo.Context) error {
 		return updateSongStates(e, c, db)
 	})
+  e.GET("/search", func(c echo.Context) error {
+		return search(e, c, db)
+	})
+  e.GET("/stream/:songId", func(c echo.Context) error {
+		return streamSong(e, c, db)
+	})
+  e.GET("/transcode/:songId", func(c echo.Context) error {
+		return transcodeSong(e, c, db)
+	})
+  e.GET("/albums/:albumId/cover", func(c echo.Context) error {
+		return getAlbumCover(e, c, db)
+	})
+  addPlaylistRoutes(e, db)
+  if config.Subsonic.Enabled {
+    addSubsonicRoutes(e, db)
+  }
 
 	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", port)))
   return nil
@@ -61,7 +82,11 @@ func getArtists(e *echo.Echo, c echo.Context, db *sql.DB) error {
     e.Logger.Errorf("Can't convert state '%s' to a number\n", stateString)
     return c.String(http.StatusBadRequest, "Can't convert state to a number\n")
   }
-  artists, err := loadArtists(db, state)
+  sublib, ok := sublibParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "No such sublib\n")
+  }
+  artists, err := loadArtists(db, state, sublib)
   if err != nil {
     e.Logger.Errorf("Error loading artists: %s\n", err.Error())
     return c.String(http.StatusBadRequest, "Error loading artists\n")
@@ -82,7 +107,11 @@ func getAlbums(e *echo.Echo, c echo.Context, db *sql.DB) error {
     e.Logger.Errorf("Can't convert state '%s' to a number\n", stateString)
     return c.String(http.StatusBadRequest, "Can't convert state to a number\n")
   }
-  artists, err := loadAlbums(db, artistId, state)
+  sublib, ok := sublibParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "No such sublib\n")
+  }
+  artists, err := loadAlbums(db, artistId, state, sublib)
   if err != nil {
     e.Logger.Errorf("Error loading albums: %s\n", err.Error())
     return c.String(http.StatusBadRequest, "Error loading albums\n")
@@ -103,7 +132,11 @@ func getSongs(e *echo.Echo, c echo.Context, db *sql.DB) error {
     e.Logger.Errorf("Can't convert state '%s' to a number\n", stateString)
     return c.String(http.StatusBadRequest, "Can't convert state to a number\n")
   }
-  songs, err := loadSongs(db, albumId, state)
+  sublib, ok := sublibParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "No such sublib\n")
+  }
+  songs, err := loadSongs(db, albumId, state, sublib)
   if err != nil {
     e.Logger.Errorf("error loading songs: %s\n", err.Error())
     return c.String(http.StatusBadRequest, "Error loading songs\n")
@@ -118,7 +151,11 @@ func getAllSongs(e *echo.Echo, c echo.Context, db *sql.DB) error {
     e.Logger.Errorf("Can't convert state '%s' to a number\n", stateString)
     return c.String(http.StatusBadRequest, "Can't convert state to a number\n")
   }
-  songs, err := loadAllSongs(db, state)
+  sublib, ok := sublibParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "No such sublib\n")
+  }
+  songs, err := loadAllSongs(db, state, sublib)
   if err != nil {
     e.Logger.Errorf("error loading songs: %s\n", err.Error())
     return c.String(http.StatusBadRequest, "Error loading songs\n")
@@ -139,7 +176,11 @@ func getAllSongsByArtist(e *echo.Echo, c echo.Context, db *sql.DB) error {
     e.Logger.Errorf("Can't convert state '%s' to a number\n", stateString)
     return c.String(http.StatusBadRequest, "Can't convert state to a number\n")
   }
-  songs, err := loadAllSongsByArtist(db, artistId, state)
+  sublib, ok := sublibParam(e, c)
+  if !ok {
+    return c.String(http.StatusBadRequest, "No such sublib\n")
+  }
+  songs, err := loadAllSongsByArtist(db, artistId, state, sublib)
   if err != nil {
     e.Logger.Errorf("error loading songs: %s\n", err.Error())
     return c.String(http.StatusBadRequest, "Error loading songs\n")
@@ -159,3 +200,49 @@ func updateSongStates(e *echo.Echo, c echo.Context, db *sql.DB) error {
   }
   return c.String(http.StatusOK, "")
 }
+
+// Returns the value of the sublib query parameter, which is empty if there
+// isn't one, and false if there is no such sublib.
+func sublibParam(e *echo.Echo, c echo.Context) (string, bool) {
+  sublib := c.QueryParam("sublib")
+  if sublib != "" && findSublib(sublib) == nil {
+    e.Logger.Errorf("No such sublib '%s'\n", sublib)
+    return "", false
+  }
+  return sublib, true
+}
+
+// Default and maximum number of results in each list returned by search.
+const defaultSearchLimit = 20
+const maxSearchLimit = 100
+
+func search(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  query := c.QueryParam("q")
+  if query == "" {
+    return c.String(http.StatusBadRequest, "Missing query\n")
+  }
+  limit := defaultSearchLimit
+  if limitString := c.QueryParam("limit"); limitString != "" {
+    var err error
+    limit, err = strconv.Atoi(limitString)
+    if err != nil || limit < 1 || limit > maxSearchLimit {
+      e.Logger.Errorf("Invalid limit '%s'\n", limitString)
+      return c.String(http.StatusBadRequest, fmt.Sprintf("Limit must be a number from 1 to %d\n", maxSearchLimit))
+    }
+  }
+  offset := 0
+  if offsetString := c.QueryParam("offset"); offsetString != "" {
+    var err error
+    offset, err = strconv.Atoi(offsetString)
+    if err != nil || offset < 0 {
+      e.Logger.Errorf("Invalid offset '%s'\n", offsetString)
+      return c.String(http.StatusBadRequest, "Offset must be a non-negative number\n")
+    }
+  }
+  results, err := loadSearchResults(db, query, limit, offset)
+  if err != nil {
+    e.Logger.Errorf("Error searching for '%s': %s\n", query, err.Error())
+    return c.String(http.StatusInternalServerError, "Error searching\n")
+  }
+  return c.JSON(http.StatusOK, results)
+}
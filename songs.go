@@ -1,8 +1,10 @@
 package main
 
 import (
+  "crypto/md5"
   "encoding/hex"
   "fmt"
+  "hash"
   "io"
   "io/fs"
   "io/ioutil"
@@ -13,6 +15,7 @@ import (
   "sort"
   "strconv"
   "strings"
+  "sync"
   "gopkg.in/yaml.v3"
   "github.com/brothertoad/btu"
   "github.com/brothertoad/tags"
@@ -32,9 +35,59 @@ var requiredKeys = []string {
 //
 ////////////////////////////////////////////////////////////////////////
 
-func loadSongMapSliceFromMusicDir(useMd5 bool) tags.TagMapSlice {
+// A songFile is a file found while walking the music directory, waiting for
+// one of the workers to read its tags.
+type songFile struct {
+  path string
+  info fs.FileInfo
+}
+
+// Walks the music directory and reads the tags of every song, using a pool
+// of jobs workers.  The result is sorted, so it does not depend on the
+// order in which the workers finish.  If known is not nil, it maps size and
+// time keys to songs that have already been read, and files that match one
+// of those keys are not opened.
+func loadSongMapSliceFromMusicDir(useMd5 bool, jobs int, known map[string]tags.TagMap) tags.TagMapSlice {
+  if jobs < 1 {
+    jobs = 1
+  }
+  files := make(chan songFile, jobs * 4)
+  results := make(chan tags.TagMap, jobs * 4)
+  var wg sync.WaitGroup
+  for j := 0; j < jobs; j++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      // Each worker has its own hasher, as a hash.Hash is not safe for concurrent use.
+      hasher := md5.New()
+      for file := range(files) {
+        if song := readSongFile(file, useMd5, hasher, known); song != nil {
+          results <- song
+        }
+      }
+    }()
+  }
+  go func() {
+    walkMusicDir(files)
+    close(files)
+    wg.Wait()
+    close(results)
+  }()
   songMaps := make(tags.TagMapSlice, 0, 5000)
-  filepath.WalkDir(config.MusicDir, func(path string, de fs.DirEntry, err error) error {
+  for song := range(results) {
+    songMaps = append(songMaps, song)
+  }
+  // Put the songs in path order first, so that songs the TagMapSlice considers
+  // equal always end up in the same order.
+  sort.Slice(songMaps, func(i, j int) bool {
+    return songMaps[i][tags.RelativePathKey] < songMaps[j][tags.RelativePathKey]
+  })
+  sort.Stable(songMaps)
+  return songMaps
+}
+
+func walkMusicDir(files chan<- songFile) {
+  filepath.WalkDir(library.MusicDir, func(path string, de fs.DirEntry, err error) error {
     if de.IsDir() {
       return nil
     }
@@ -43,31 +96,41 @@ func loadSongMapSliceFromMusicDir(useMd5 bool) tags.TagMapSlice {
     if len(name) == 0 || name[0] == '.' {
       return nil
     }
-    song := tags.GetStandardTagsFromFile(path)
-    if song == nil || len(song) == 0 {
-      return nil
-    }
-    setPaths(song, path)
-    song[tags.FlagsKey] = ""
-    addSortKeys(song)
-    if useMd5 {
-		addMd5Key(song)
-	} else {
-		song[tags.Md5Key] = ""
-	}
     info, err := de.Info()
     btu.CheckError2(err, "Couldn't get fileInfo for '%s'\n", path)
-    song[tags.SizeAndTimeKey] = fmt.Sprintf("%d-%d", info.Size(), info.ModTime().Unix())
-    checkForMissingKeys(song)
-    songMaps = append(songMaps, filterKeys(song))
+    files <- songFile{path, info}
     return nil
   })
-  sort.Sort(songMaps)
-  return songMaps
+}
+
+func readSongFile(file songFile, useMd5 bool, hasher hash.Hash, known map[string]tags.TagMap) tags.TagMap {
+  sizeAndTime := fmt.Sprintf("%d-%d", file.info.Size(), file.info.ModTime().Unix())
+  if knownSong, present := known[sizeAndTime]; present {
+    // The file hasn't changed, although it may have moved, so we only
+    // need to update the paths.
+    song := filterKeys(knownSong)
+    setPaths(song, file.path)
+    return song
+  }
+  song := tags.GetStandardTagsFromFile(file.path)
+  if song == nil || len(song) == 0 {
+    return nil
+  }
+  setPaths(song, file.path)
+  song[tags.FlagsKey] = ""
+  addSortKeys(song)
+  if useMd5 {
+    addMd5Key(song, hasher)
+  } else {
+    song[tags.Md5Key] = ""
+  }
+  song[tags.SizeAndTimeKey] = sizeAndTime
+  checkForMissingKeys(song)
+  return filterKeys(song)
 }
 
 func setPaths(song tags.TagMap, path string) {
-  relativePath := path[musicDirLength:]
+  relativePath := path[len(library.MusicDir):]
   song[tags.RelativePathKey] = relativePath
   // Remove the extension to get the base path.
   pathLength := len(relativePath)
@@ -113,8 +176,8 @@ func getSortValue(pureValue string) string {
   return pureValue
 }
 
-func addMd5Key(song tags.TagMap) {
-  f, err := os.Open(path.Join(config.MusicDir,song[tags.RelativePathKey]))
+func addMd5Key(song tags.TagMap, hasher hash.Hash) {
+  f, err := os.Open(path.Join(library.MusicDir,song[tags.RelativePathKey]))
   btu.CheckError(err)
   defer f.Close()
   hasher.Reset()
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "mime"
+  "net/http"
+  "os"
+  "path"
+  "strconv"
+  "strings"
+  "github.com/labstack/echo/v4"
+)
+
+// Returns the selected library with the given name, or nil if the library
+// isn't selected (or doesn't exist).
+func findSelectedLibrary(name string) *LibraryInfo {
+  for _, lib := range(selectedLibraries) {
+    if lib.Name == name {
+      return lib
+    }
+  }
+  return nil
+}
+
+// Returns the path and mime type of the file for a song.  If encoderExtension is not
+// empty, it is the extension of the encoder whose output is wanted, rather
+// than the original file.
+func songFilePath(lib *LibraryInfo, song Song, encoderExtension string) (string, string, error) {
+  if encoderExtension == "" {
+    return path.Join(lib.MusicDir, song.RelativePath), song.Mime, nil
+  }
+  for _, encoder := range(lib.Encoders) {
+    if encoder.Extension != encoderExtension {
+      continue
+    }
+    filePath, present := encodedPath(encoder, song)
+    if !present {
+      return "", "", fmt.Errorf("encoder %s does not include song %d", encoderExtension, song.Id)
+    }
+    if song.IsEncoded {
+      return filePath, song.Mime, nil
+    }
+    return filePath, mimeTypeForExtension(encoder.Extension), nil
+  }
+  return "", "", fmt.Errorf("library %s has no encoder %s", lib.Name, encoderExtension)
+}
+
+func mimeTypeForExtension(extension string) string {
+  mimeType := mime.TypeByExtension("." + strings.TrimPrefix(extension, "."))
+  if mimeType == "" {
+    return "application/octet-stream"
+  }
+  return mimeType
+}
+
+func streamSong(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  songString := c.Param("songId")
+  songId, err := strconv.Atoi(songString)
+  if err != nil {
+    e.Logger.Errorf("Can't convert songId '%s' to a number\n", songString)
+    return c.String(http.StatusBadRequest, "Can't convert songId to a number\n")
+  }
+  return sendSongFile(e, c, db, songId, c.QueryParam("encoder"))
+}
+
+// Send the file for a song, or the output of one of the encoders if
+// encoderExtension is not empty.  http.ServeContent takes care of range
+// requests, so clients can seek.
+func sendSongFile(e *echo.Echo, c echo.Context, db *sql.DB, songId int, encoderExtension string) error {
+  song, libraryName, err := loadSongWithLibrary(db, songId)
+  if err == sql.ErrNoRows {
+    return c.String(http.StatusNotFound, "No such song\n")
+  }
+  if err != nil {
+    e.Logger.Errorf("Error loading song %d: %s\n", songId, err.Error())
+    return c.String(http.StatusInternalServerError, "Error loading song\n")
+  }
+  lib := findSelectedLibrary(libraryName)
+  if lib == nil {
+    return c.String(http.StatusNotFound, "No such song\n")
+  }
+  filePath, mimeType, err := songFilePath(lib, song, encoderExtension)
+  if err != nil {
+    e.Logger.Errorf("Can't stream song %d: %s\n", songId, err.Error())
+    return c.String(http.StatusNotFound, err.Error() + "\n")
+  }
+  file, err := os.Open(filePath)
+  if err != nil {
+    e.Logger.Errorf("Can't open '%s': %s\n", filePath, err.Error())
+    return c.String(http.StatusNotFound, "Song file is missing\n")
+  }
+  defer file.Close()
+  info, err := file.Stat()
+  if err != nil {
+    e.Logger.Errorf("Can't stat '%s': %s\n", filePath, err.Error())
+    return c.String(http.StatusInternalServerError, "Error reading song file\n")
+  }
+  c.Response().Header().Set(echo.HeaderContentType, mimeType)
+  http.ServeContent(c.Response(), c.Request(), path.Base(filePath), info.ModTime(), file)
+  return nil
+}
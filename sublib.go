@@ -0,0 +1,519 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "io"
+  "io/fs"
+  "os"
+  "path"
+  "path/filepath"
+  "sort"
+  "strings"
+  "github.com/urfave/cli/v2"
+)
+
+var sublibCommand = cli.Command {
+  Name: "sublib",
+  Usage: "update the directories of sub-libraries",
+  ArgsUsage: "[name...]",
+  Flags: []cli.Flag {
+    &cli.BoolFlag {Name: dryRunFlag, Aliases: []string{"n"}, Usage: "report what would change without changing anything"},
+  },
+  Action: doSublib,
+}
+
+// Values of the link setting of a sublib.
+const sublibCopy = "copy"
+const sublibHardlink = "hardlink"
+const sublibSymlink = "symlink"
+
+// A song, with the names of its artist and album, for deciding which
+// sublibs it is in.
+type sublibSong struct {
+  *Song
+  Artist string
+  Album string
+}
+
+// Update the sublibs with the given names, or all of them if no names are
+// given.  The sublibs column of every song is updated as well.
+func doSublib(c *cli.Context) error {
+  for _, name := range(c.Args().Slice()) {
+    if findSublib(name) == nil {
+      return fmt.Errorf("no sublib named '%s' in the selected libraries", name)
+    }
+  }
+  db := getDbConnection()
+  defer db.Close()
+  return forEachLibrary(func() error {
+    return sublibLibrary(c, db)
+  })
+}
+
+// Returns the sublib of a selected library with the given name, or nil.
+func findSublib(name string) *SublibInfo {
+  for _, lib := range(selectedLibraries) {
+    for i := range(lib.Sublibs) {
+      if lib.Sublibs[i].Name == name {
+        return &lib.Sublibs[i]
+      }
+    }
+  }
+  return nil
+}
+
+func sublibLibrary(c *cli.Context, db *sql.DB) error {
+  if len(library.Sublibs) == 0 {
+    if verbose {
+      fmt.Printf("Library %s has no sublibs\n", library.Name)
+    }
+    return nil
+  }
+  validateEncoders(library)
+  dryRun := c.Bool(dryRunFlag)
+  songs, members, err := updateSublibMembership(db, dryRun)
+  if err != nil {
+    return err
+  }
+  for i := range(library.Sublibs) {
+    sub := &library.Sublibs[i]
+    if c.NArg() > 0 && !containsString(c.Args().Slice(), sub.Name) {
+      continue
+    }
+    if err := materializeSublib(sub, songs, members[i], dryRun); err != nil {
+      return fmt.Errorf("sublib %s: %w", sub.Name, err)
+    }
+  }
+  return nil
+}
+
+// Find the songs of the current library that are in each of its sublibs, and
+// record it in the sublibs column.  Returns the songs, and the ids of the
+// songs in each sublib.
+func updateSublibMembership(db *sql.DB, dryRun bool) ([]sublibSong, []map[int]bool, error) {
+  if err := validateSublibs(library); err != nil {
+    return nil, nil, err
+  }
+  songs := loadSublibSongs(db)
+  members := make([]map[int]bool, len(library.Sublibs))
+  for i := range(library.Sublibs) {
+    var err error
+    members[i], err = findSublibMembers(db, &library.Sublibs[i], songs)
+    if err != nil {
+      return nil, nil, err
+    }
+  }
+  if err := updateSublibsColumn(db, songs, members, dryRun); err != nil {
+    return nil, nil, err
+  }
+  return songs, members, nil
+}
+
+func validateSublibs(lib *LibraryInfo) error {
+  names := make(map[string]bool)
+  for _, sub := range(lib.Sublibs) {
+    if sub.Name == "" || strings.Contains(sub.Name, ",") {
+      return fmt.Errorf("sublib '%s' of library %s must have a name without commas", sub.Name, lib.Name)
+    }
+    if names[sub.Name] {
+      return fmt.Errorf("library %s has more than one sublib named %s", lib.Name, sub.Name)
+    }
+    names[sub.Name] = true
+    if sub.Dir == "" {
+      return fmt.Errorf("sublib %s does not have a directory", sub.Name)
+    }
+    if sub.Link != "" && sub.Link != sublibCopy && sub.Link != sublibHardlink && sub.Link != sublibSymlink {
+      return fmt.Errorf("sublib %s has unknown link '%s'; use %s, %s or %s", sub.Name, sub.Link, sublibCopy, sublibHardlink, sublibSymlink)
+    }
+    if sub.Encoder != "" && findEncoder(lib, sub.Encoder) == nil {
+      return fmt.Errorf("sublib %s uses encoder %s, which library %s does not have", sub.Name, sub.Encoder, lib.Name)
+    }
+  }
+  for i := range(lib.Sublibs) {
+    sub := &lib.Sublibs[i]
+    if sub.Filter == "" {
+      continue
+    }
+    filter, err := parseSublibFilter(sub.Filter)
+    if err != nil {
+      return fmt.Errorf("filter of sublib %s: %w", sub.Name, err)
+    }
+    sub.filter = filter
+  }
+  return nil
+}
+
+func findEncoder(lib *LibraryInfo, extension string) *EncoderInfo {
+  for i := range(lib.Encoders) {
+    if lib.Encoders[i].Extension == extension {
+      return &lib.Encoders[i]
+    }
+  }
+  return nil
+}
+
+// Load the songs of the current library, sorted by relative path.
+func loadSublibSongs(db *sql.DB) []sublibSong {
+  songs := make([]sublibSong, 0)
+  for _, artist := range(readArtistMapFromDb(db)) {
+    for _, album := range(artist.Albums) {
+      for _, song := range(album.Songs) {
+        songs = append(songs, sublibSong{song, artist.Name, album.Title})
+      }
+    }
+  }
+  sort.Slice(songs, func(i, j int) bool {
+    return songs[i].RelativePath < songs[j].RelativePath
+  })
+  return songs
+}
+
+// Returns the ids of the songs that are in a sublib.
+func findSublibMembers(db *sql.DB, sub *SublibInfo, songs []sublibSong) (map[int]bool, error) {
+  members := make(map[int]bool)
+  explicit := make(map[string]bool)
+  for _, relativePath := range(sub.Songs) {
+    explicit[normalizeSongPath(relativePath)] = true
+  }
+  for _, name := range(sub.Playlists) {
+    songIds, err := loadPlaylistSongIds(db, name)
+    if err != nil {
+      return members, err
+    }
+    if len(songIds) == 0 {
+      fmt.Printf("Warning: playlist '%s' of sublib %s is empty or does not exist\n", name, sub.Name)
+    }
+    for _, songId := range(songIds) {
+      members[songId] = true
+    }
+  }
+  hasRules := len(sub.Artists) > 0 || len(sub.Albums) > 0 || len(sub.Extensions) > 0 || len(sub.Flags) > 0 || sub.filter != nil
+  for _, song := range(songs) {
+    if explicit[normalizeSongPath(song.RelativePath)] || (hasRules && sub.matches(song)) {
+      members[song.Id] = true
+    }
+  }
+  return members, nil
+}
+
+// Returns a path relative to the music directory the way the database has
+// it, with a leading slash, so that the paths of songs in the configuration
+// can be written with or without one.
+func normalizeSongPath(relativePath string) string {
+  return "/" + strings.TrimPrefix(filepath.ToSlash(relativePath), "/")
+}
+
+// Returns true if a song matches every rule of a sublib.  Names and titles
+// are compared without regard to case.
+func (sub *SublibInfo) matches(song sublibSong) bool {
+  if len(sub.Artists) > 0 && !containsFold(sub.Artists, song.Artist) {
+    return false
+  }
+  if len(sub.Albums) > 0 && !containsFold(sub.Albums, song.Album) {
+    return false
+  }
+  if len(sub.Extensions) > 0 && !containsFold(sub.Extensions, song.Extension) {
+    return false
+  }
+  if len(sub.Flags) > 0 && !containsAnyFold(sub.Flags, songFlags(song.Flags)) {
+    return false
+  }
+  return sub.filter == nil || sub.filter.matches(song)
+}
+
+// Returns the flags of a song, which are separated by commas or spaces.
+func songFlags(flags string) []string {
+  return strings.FieldsFunc(flags, func(r rune) bool {
+    return r == ',' || r == ' '
+  })
+}
+
+func containsString(list []string, s string) bool {
+  for _, item := range(list) {
+    if item == s {
+      return true
+    }
+  }
+  return false
+}
+
+func containsAnyFold(list, values []string) bool {
+  for _, value := range(values) {
+    if containsFold(list, value) {
+      return true
+    }
+  }
+  return false
+}
+
+func containsFold(list []string, s string) bool {
+  for _, item := range(list) {
+    if strings.EqualFold(item, s) {
+      return true
+    }
+  }
+  return false
+}
+
+// Set the sublibs column of each song to the comma separated names of the
+// sublibs it is in.
+func updateSublibsColumn(db *sql.DB, songs []sublibSong, members []map[int]bool, dryRun bool) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  defer tx.Rollback()
+  changed := 0
+  for _, song := range(songs) {
+    names := make([]string, 0)
+    for i, sub := range(library.Sublibs) {
+      if members[i][song.Id] {
+        names = append(names, sub.Name)
+      }
+    }
+    sublibs := strings.Join(names, ",")
+    if sublibs == song.Sublibs {
+      continue
+    }
+    changed++
+    if dryRun {
+      continue
+    }
+    if err := updateSongSublibs(tx, song.Id, sublibs); err != nil {
+      return err
+    }
+  }
+  if verbose || changed > 0 {
+    if dryRun {
+      fmt.Printf("Sublibs of %d songs would change\n", changed)
+    } else {
+      fmt.Printf("Sublibs of %d songs changed\n", changed)
+    }
+  }
+  return tx.Commit()
+}
+
+// Put the files of the songs in a sublib in its directory, and remove any
+// other files from it.
+func materializeSublib(sub *SublibInfo, songs []sublibSong, members map[int]bool, dryRun bool) error {
+  if err := checkSublibDir(sub); err != nil {
+    return err
+  }
+  link := sub.Link
+  if link == "" {
+    link = sublibCopy
+  }
+  // Map the path of each file in the sublib to the file it comes from.
+  wanted := make(map[string]string)
+  targets := make([]string, 0, len(members))
+  for _, song := range(songs) {
+    if !members[song.Id] {
+      continue
+    }
+    src := path.Join(library.MusicDir, song.RelativePath)
+    relativePath := song.RelativePath
+    if sub.Encoder != "" {
+      encoder := findEncoder(library, sub.Encoder)
+      var included bool
+      src, included = encodedPath(*encoder, *song.Song)
+      if !included {
+        continue
+      }
+      var err error
+      relativePath, err = filepath.Rel(encoder.Directory, src)
+      if err != nil {
+        return err
+      }
+    }
+    target := filepath.Join(sub.Dir, relativePath)
+    wanted[target] = src
+    targets = append(targets, target)
+  }
+
+  added, unchanged := 0, 0
+  for _, target := range(targets) {
+    src := wanted[target]
+    if _, err := os.Stat(src); err != nil {
+      fmt.Printf("Skipping '%s', which does not exist\n", src)
+      continue
+    }
+    if sublibFileIsCurrent(link, src, target) {
+      unchanged++
+      continue
+    }
+    added++
+    if dryRun {
+      fmt.Printf("Would add %s\n", target)
+      continue
+    }
+    if verbose {
+      fmt.Printf("Adding %s\n", target)
+    }
+    if err := placeSublibFile(link, src, target); err != nil {
+      return err
+    }
+  }
+
+  removed, err := pruneTree(sub.Dir, func(p string) bool {
+    _, present := wanted[p]
+    return present
+  }, dryRun)
+  if err != nil {
+    return err
+  }
+  fmt.Printf("Sublib %s: %d files added, %d removed, %d unchanged\n", sub.Name, added, removed, unchanged)
+  return nil
+}
+
+// Returns an error if the directory of a sublib overlaps the music directory
+// or an encoder directory of the current library, as the files in it that
+// aren't in the sublib are removed.
+func checkSublibDir(sub *SublibInfo) error {
+  dir, err := filepath.Abs(sub.Dir)
+  if err != nil {
+    return err
+  }
+  dirs := []string{library.MusicDir}
+  for _, encoder := range(library.Encoders) {
+    dirs = append(dirs, encoder.Directory)
+  }
+  for _, other := range(dirs) {
+    other, err := filepath.Abs(other)
+    if err != nil {
+      return err
+    }
+    if pathContains(other, dir) || pathContains(dir, other) {
+      return fmt.Errorf("not updating, as its directory overlaps %s", other)
+    }
+  }
+  return nil
+}
+
+// Returns true if dir is, or is inside, parent.
+func pathContains(parent, dir string) bool {
+  rel, err := filepath.Rel(parent, dir)
+  return err == nil && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator))
+}
+
+// Returns true if the file in a sublib is already the file it comes from.
+func sublibFileIsCurrent(link, src, target string) bool {
+  switch link {
+  case sublibSymlink:
+    dest, err := os.Readlink(target)
+    abs, absErr := filepath.Abs(src)
+    return err == nil && absErr == nil && dest == abs
+  case sublibHardlink:
+    srcInfo, srcErr := os.Stat(src)
+    targetInfo, targetErr := os.Lstat(target)
+    return srcErr == nil && targetErr == nil && os.SameFile(srcInfo, targetInfo)
+  }
+  srcInfo, srcErr := os.Stat(src)
+  targetInfo, targetErr := os.Lstat(target)
+  return srcErr == nil && targetErr == nil && targetInfo.Mode().IsRegular() &&
+    srcInfo.Size() == targetInfo.Size() && srcInfo.ModTime().Equal(targetInfo.ModTime())
+}
+
+func placeSublibFile(link, src, target string) error {
+  if err := os.MkdirAll(filepath.Dir(target), 0775); err != nil {
+    return err
+  }
+  if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+    return err
+  }
+  switch link {
+  case sublibSymlink:
+    abs, err := filepath.Abs(src)
+    if err != nil {
+      return err
+    }
+    return os.Symlink(abs, target)
+  case sublibHardlink:
+    return os.Link(src, target)
+  }
+  return copyFile(src, target)
+}
+
+// Copy a file, giving the copy the modification time of the original.  The
+// copy is written to a temporary file that is renamed when it is complete.
+func copyFile(src, dest string) error {
+  in, err := os.Open(src)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  info, err := in.Stat()
+  if err != nil {
+    return err
+  }
+  out, err := os.CreateTemp(filepath.Dir(dest), ".tmp-*")
+  if err != nil {
+    return err
+  }
+  defer os.Remove(out.Name())
+  if _, err := io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+  if err := out.Close(); err != nil {
+    return err
+  }
+  if err := os.Chmod(out.Name(), 0644); err != nil {
+    return err
+  }
+  if err := os.Chtimes(out.Name(), info.ModTime(), info.ModTime()); err != nil {
+    return err
+  }
+  return os.Rename(out.Name(), dest)
+}
+
+// Remove the files under root that keep returns false for, and then any
+// directories that are left empty.  In a dry run, the files are listed
+// rather than removed.  Returns the number of files removed.
+func pruneTree(root string, keep func(string) bool, dryRun bool) (int, error) {
+  removed := 0
+  dirs := make([]string, 0)
+  err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+    if err != nil {
+      if os.IsNotExist(err) && p == root {
+        return filepath.SkipDir
+      }
+      return err
+    }
+    if d.IsDir() {
+      if p != root {
+        dirs = append(dirs, p)
+      }
+      return nil
+    }
+    if keep(p) {
+      return nil
+    }
+    removed++
+    if dryRun {
+      fmt.Printf("Would remove %s\n", p)
+      return nil
+    }
+    if verbose {
+      fmt.Printf("Removing %s\n", p)
+    }
+    return os.Remove(p)
+  })
+  if err == nil && !dryRun {
+    removeEmptyDirs(dirs)
+  }
+  return removed, err
+}
+
+// Remove the directories that are empty, deepest first, so that directories
+// that only held empty directories are removed too.
+func removeEmptyDirs(dirs []string) {
+  sort.Slice(dirs, func(i, j int) bool {
+    return len(dirs[i]) > len(dirs[j])
+  })
+  for _, dir := range(dirs) {
+    if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+      os.Remove(dir)
+    }
+  }
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestFindSublibMembers(t *testing.T) {
+  songs := []sublibSong{
+    {&Song{Id: 1, RelativePath: "/Miles Davis/Kind of Blue/01 So What.flac", Extension: ".flac"}, "Miles Davis", "Kind of Blue"},
+    {&Song{Id: 2, RelativePath: "/Miles Davis/Kind of Blue/02 Freddie Freeloader.flac", Extension: ".flac", Flags: "live"}, "Miles Davis", "Kind of Blue"},
+    {&Song{Id: 3, RelativePath: "/Bill Evans/Sunday at the Village Vanguard/01 Gloria's Step.mp3", Extension: ".mp3", Flags: "live,favorite"}, "Bill Evans", "Sunday at the Village Vanguard"},
+  }
+  tests := []struct {
+    name string
+    sub SublibInfo
+    want []int
+  }{
+    {"no rules", SublibInfo{}, nil},
+    {"song with a leading slash", SublibInfo{Songs: []string{"/Miles Davis/Kind of Blue/01 So What.flac"}}, []int{1}},
+    {"song without a leading slash", SublibInfo{Songs: []string{"Miles Davis/Kind of Blue/01 So What.flac"}}, []int{1}},
+    {"song that doesn't exist", SublibInfo{Songs: []string{"Miles Davis/Kind of Blue/03 Blue in Green.flac"}}, nil},
+    {"artist", SublibInfo{Artists: []string{"miles davis"}}, []int{1, 2}},
+    {"album", SublibInfo{Albums: []string{"Sunday at the Village Vanguard"}}, []int{3}},
+    {"extension", SublibInfo{Extensions: []string{".FLAC"}}, []int{1, 2}},
+    {"flag", SublibInfo{Flags: []string{"live"}}, []int{2, 3}},
+    {"every rule", SublibInfo{Artists: []string{"Miles Davis"}, Flags: []string{"live"}}, []int{2}},
+    {"rules and songs", SublibInfo{Flags: []string{"favorite"}, Songs: []string{"Miles Davis/Kind of Blue/01 So What.flac"}}, []int{1, 3}},
+  }
+  for _, test := range(tests) {
+    members, err := findSublibMembers(nil, &test.sub, songs)
+    if err != nil {
+      t.Errorf("%s: %v", test.name, err)
+      continue
+    }
+    if len(members) != len(test.want) {
+      t.Errorf("%s: got %v, want %v", test.name, members, test.want)
+      continue
+    }
+    for _, id := range(test.want) {
+      if !members[id] {
+        t.Errorf("%s: got %v, want %v", test.name, members, test.want)
+        break
+      }
+    }
+  }
+}
+
+func TestNormalizeSongPath(t *testing.T) {
+  tests := map[string]string{
+    "Artist/Album/song.flac": "/Artist/Album/song.flac",
+    "/Artist/Album/song.flac": "/Artist/Album/song.flac",
+    "song.flac": "/song.flac",
+  }
+  for relativePath, want := range(tests) {
+    if got := normalizeSongPath(relativePath); got != want {
+      t.Errorf("normalizeSongPath(%q) = %q, want %q", relativePath, got, want)
+    }
+  }
+}
+
+func TestPathContains(t *testing.T) {
+  tests := []struct {
+    parent string
+    dir string
+    want bool
+  }{
+    {"/music", "/music", true},
+    {"/music", "/music/mp3", true},
+    {"/music", "/music/a/b/c", true},
+    {"/music/", "/music/mp3/", true},
+    {"/music", "/musicmp3", false},
+    {"/music", "/", false},
+    {"/music/mp3", "/music", false},
+    {"/music", "/music/../other", false},
+    {"/music", "/music/..mp3", true},
+    {"/", "/music", true},
+  }
+  for _, test := range(tests) {
+    if got := pathContains(filepath.FromSlash(test.parent), filepath.FromSlash(test.dir)); got != test.want {
+      t.Errorf("pathContains(%q, %q) = %v, want %v", test.parent, test.dir, got, test.want)
+    }
+  }
+}
+
+func TestCheckSublibDir(t *testing.T) {
+  root := t.TempDir()
+  saved := library
+  t.Cleanup(func() { library = saved })
+  library = &LibraryInfo{
+    Name: "test",
+    MusicDir: filepath.Join(root, "music"),
+    Encoders: []EncoderInfo{{Extension: ".mp3", Directory: filepath.Join(root, "mp3")}},
+  }
+  tests := []struct {
+    dir string
+    wantErr bool
+  }{
+    {filepath.Join(root, "sublib"), false},
+    {filepath.Join(root, "musicals"), false},
+    {filepath.Join(root, "music"), true},
+    {filepath.Join(root, "music", "sublib"), true},
+    {root, true},
+    {filepath.Join(root, "mp3", "sublib"), true},
+    {filepath.Join(root, "music", "..", "mp3"), true},
+  }
+  for _, test := range(tests) {
+    err := checkSublibDir(&SublibInfo{Name: "sub", Dir: test.dir})
+    if (err != nil) != test.wantErr {
+      t.Errorf("%s: err = %v, want error %v", test.dir, err, test.wantErr)
+    }
+  }
+}
+
+func TestMaterializeSublib(t *testing.T) {
+  root := t.TempDir()
+  saved := library
+  t.Cleanup(func() { library = saved })
+  library = &LibraryInfo{Name: "test", MusicDir: filepath.Join(root, "music")}
+  writeTestFile(t, filepath.Join(root, "music", "a", "one.flac"), "one")
+  writeTestFile(t, filepath.Join(root, "music", "a", "two.flac"), "two")
+  writeTestFile(t, filepath.Join(root, "sublib", "old", "stale.flac"), "stale")
+  songs := []sublibSong{
+    {&Song{Id: 1, RelativePath: "/a/one.flac"}, "", ""},
+    {&Song{Id: 2, RelativePath: "/a/two.flac"}, "", ""},
+  }
+  members := map[int]bool{1: true}
+
+  // A dry run doesn't change anything.
+  sub := &SublibInfo{Name: "sub", Dir: filepath.Join(root, "sublib")}
+  if err := materializeSublib(sub, songs, members, true); err != nil {
+    t.Fatalf("dry run: %v", err)
+  }
+  if _, err := os.Stat(filepath.Join(root, "sublib", "a", "one.flac")); !os.IsNotExist(err) {
+    t.Errorf("dry run added a file")
+  }
+  if _, err := os.Stat(filepath.Join(root, "sublib", "old", "stale.flac")); err != nil {
+    t.Errorf("dry run removed a file")
+  }
+
+  if err := materializeSublib(sub, songs, members, false); err != nil {
+    t.Fatalf("materializeSublib: %v", err)
+  }
+  if data, err := os.ReadFile(filepath.Join(root, "sublib", "a", "one.flac")); err != nil || string(data) != "one" {
+    t.Errorf("member = %q, %v, want %q", data, err, "one")
+  }
+  for _, p := range([]string{filepath.Join("a", "two.flac"), filepath.Join("old", "stale.flac"), "old"}) {
+    if _, err := os.Stat(filepath.Join(root, "sublib", p)); !os.IsNotExist(err) {
+      t.Errorf("%s was not removed", p)
+    }
+  }
+
+  // A sublib in the music directory would remove the songs that aren't in it.
+  sub = &SublibInfo{Name: "bad", Dir: library.MusicDir}
+  if err := materializeSublib(sub, songs, members, false); err == nil {
+    t.Errorf("sublib in the music directory was updated")
+  }
+  if _, err := os.Stat(filepath.Join(root, "music", "a", "two.flac")); err != nil {
+    t.Errorf("song removed from the music directory: %v", err)
+  }
+}
+
+func writeTestFile(t *testing.T, p, content string) {
+  t.Helper()
+  if err := os.MkdirAll(filepath.Dir(p), 0775); err != nil {
+    t.Fatal(err)
+  }
+  if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+    t.Fatal(err)
+  }
+}
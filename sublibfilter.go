@@ -0,0 +1,318 @@
+package main
+
+import (
+  "fmt"
+  "strconv"
+  "strings"
+  "time"
+  "unicode"
+)
+
+// Filter expressions select the songs of a sublib.  An expression compares
+// fields of songs with values, and comparisons can be combined with and, or
+// and not, and grouped with parentheses.  For example:
+//
+//   artist = "Miles Davis" and (duration < 10:00 or flags = live)
+//   extension = .flac and state != 0 and added > 90d
+//
+// The fields are artist, album, title, extension, flags, duration, state and
+// added.  Text fields are compared without regard to case with =, != and ~
+// (contains) and !~ (doesn't contain).  For flags, = and != test whether the
+// song has the flag.  Duration, state and added are compared with =, !=, <,
+// <=, > and >=.  Durations are seconds or [h:]m:ss, and added is compared
+// with a date (2006-01-02) or a time before now (30d, 12w, 6m or 1y).  Values
+// with spaces or operators in them must be quoted.
+
+type sublibFilter interface {
+  matches(song sublibSong) bool
+}
+
+type andFilter struct {
+  left, right sublibFilter
+}
+
+func (f andFilter) matches(song sublibSong) bool {
+  return f.left.matches(song) && f.right.matches(song)
+}
+
+type orFilter struct {
+  left, right sublibFilter
+}
+
+func (f orFilter) matches(song sublibSong) bool {
+  return f.left.matches(song) || f.right.matches(song)
+}
+
+type notFilter struct {
+  filter sublibFilter
+}
+
+func (f notFilter) matches(song sublibSong) bool {
+  return !f.filter.matches(song)
+}
+
+type textFilter struct {
+  field func(song sublibSong) string
+  op string
+  value string
+}
+
+func (f textFilter) matches(song sublibSong) bool {
+  s := strings.ToLower(f.field(song))
+  switch f.op {
+  case "=":
+    return s == f.value
+  case "!=":
+    return s != f.value
+  case "~":
+    return strings.Contains(s, f.value)
+  }
+  return !strings.Contains(s, f.value)
+}
+
+type flagFilter struct {
+  op string
+  value string
+}
+
+func (f flagFilter) matches(song sublibSong) bool {
+  if f.op == "~" || f.op == "!~" {
+    return textFilter{func(song sublibSong) string { return song.Flags }, f.op, f.value}.matches(song)
+  }
+  hasFlag := containsFold(songFlags(song.Flags), f.value)
+  return hasFlag == (f.op == "=")
+}
+
+type numberFilter struct {
+  field func(song sublibSong) int64
+  op string
+  value int64
+}
+
+func (f numberFilter) matches(song sublibSong) bool {
+  n := f.field(song)
+  switch f.op {
+  case "=":
+    return n == f.value
+  case "!=":
+    return n != f.value
+  case "<":
+    return n < f.value
+  case "<=":
+    return n <= f.value
+  case ">":
+    return n > f.value
+  }
+  return n >= f.value
+}
+
+var textFields = map[string]func(song sublibSong) string {
+  "artist": func(song sublibSong) string { return song.Artist },
+  "album": func(song sublibSong) string { return song.Album },
+  "title": func(song sublibSong) string { return song.Title },
+  "extension": func(song sublibSong) string { return song.Extension },
+}
+
+// Parse a filter expression.
+func parseSublibFilter(expression string) (sublibFilter, error) {
+  tokens, err := tokenizeFilter(expression)
+  if err != nil {
+    return nil, err
+  }
+  p := &filterParser{tokens: tokens}
+  filter, err := p.parseOr()
+  if err != nil {
+    return nil, err
+  }
+  if p.pos < len(p.tokens) {
+    return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos].text)
+  }
+  return filter, nil
+}
+
+type filterToken struct {
+  text string
+  quoted bool
+}
+
+var filterOperators = []string{"!=", "!~", "<=", ">=", "=", "~", "<", ">", "(", ")"}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+  tokens := make([]filterToken, 0)
+  runes := []rune(expression)
+  for i := 0; i < len(runes); {
+    r := runes[i]
+    if unicode.IsSpace(r) {
+      i++
+      continue
+    }
+    if r == '"' || r == '\'' {
+      end := i + 1
+      for end < len(runes) && runes[end] != r {
+        end++
+      }
+      if end == len(runes) {
+        return nil, fmt.Errorf("unterminated string in filter")
+      }
+      tokens = append(tokens, filterToken{string(runes[i + 1:end]), true})
+      i = end + 1
+      continue
+    }
+    operator := ""
+    for _, op := range(filterOperators) {
+      if strings.HasPrefix(string(runes[i:]), op) {
+        operator = op
+        break
+      }
+    }
+    if operator != "" {
+      tokens = append(tokens, filterToken{operator, false})
+      i += len([]rune(operator))
+      continue
+    }
+    start := i
+    for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("\"'!=~<>()", runes[i]) {
+      i++
+    }
+    tokens = append(tokens, filterToken{string(runes[start:i]), false})
+  }
+  return tokens, nil
+}
+
+type filterParser struct {
+  tokens []filterToken
+  pos int
+}
+
+// Returns true, and moves past the next token, if it is the given keyword
+// or operator.
+func (p *filterParser) accept(text string) bool {
+  if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, text) {
+    p.pos++
+    return true
+  }
+  return false
+}
+
+func (p *filterParser) next() (filterToken, error) {
+  if p.pos >= len(p.tokens) {
+    return filterToken{}, fmt.Errorf("unexpected end of filter")
+  }
+  p.pos++
+  return p.tokens[p.pos - 1], nil
+}
+
+func (p *filterParser) parseOr() (sublibFilter, error) {
+  left, err := p.parseAnd()
+  for err == nil && p.accept("or") {
+    var right sublibFilter
+    right, err = p.parseAnd()
+    left = orFilter{left, right}
+  }
+  return left, err
+}
+
+func (p *filterParser) parseAnd() (sublibFilter, error) {
+  left, err := p.parseNot()
+  for err == nil && p.accept("and") {
+    var right sublibFilter
+    right, err = p.parseNot()
+    left = andFilter{left, right}
+  }
+  return left, err
+}
+
+func (p *filterParser) parseNot() (sublibFilter, error) {
+  if p.accept("not") {
+    filter, err := p.parseNot()
+    return notFilter{filter}, err
+  }
+  if p.accept("(") {
+    filter, err := p.parseOr()
+    if err == nil && !p.accept(")") {
+      err = fmt.Errorf("missing ')'")
+    }
+    return filter, err
+  }
+  return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (sublibFilter, error) {
+  fieldToken, err := p.next()
+  if err != nil {
+    return nil, err
+  }
+  opToken, err := p.next()
+  if err != nil {
+    return nil, err
+  }
+  valueToken, err := p.next()
+  if err != nil {
+    return nil, err
+  }
+  field := strings.ToLower(fieldToken.text)
+  op := opToken.text
+  value := valueToken.text
+  if opToken.quoted || !containsString(filterOperators[:8], op) {
+    return nil, fmt.Errorf("expected a comparison after '%s', not '%s'", fieldToken.text, op)
+  }
+  textOp := op == "=" || op == "!=" || op == "~" || op == "!~"
+  numberOp := op != "~" && op != "!~"
+  if getText, present := textFields[field]; present {
+    if !textOp {
+      return nil, fmt.Errorf("%s can't be compared with %s", field, op)
+    }
+    return textFilter{getText, op, strings.ToLower(value)}, nil
+  }
+  switch field {
+  case "flags":
+    if !textOp {
+      return nil, fmt.Errorf("flags can't be compared with %s", op)
+    }
+    return flagFilter{op, strings.ToLower(value)}, nil
+  case "duration":
+    seconds := durationSeconds(value)
+    if !numberOp || (seconds == 0 && strings.Trim(value, "0:.") != "") {
+      return nil, fmt.Errorf("invalid duration comparison '%s %s'", op, value)
+    }
+    return numberFilter{func(song sublibSong) int64 { return int64(durationSeconds(song.Duration)) }, op, int64(seconds)}, nil
+  case "state":
+    state, err := strconv.ParseInt(value, 10, 64)
+    if !numberOp || err != nil {
+      return nil, fmt.Errorf("invalid state comparison '%s %s'", op, value)
+    }
+    return numberFilter{func(song sublibSong) int64 { return int64(song.State) }, op, state}, nil
+  case "added":
+    added, err := parseFilterTime(value, time.Now())
+    if !numberOp || err != nil {
+      return nil, fmt.Errorf("invalid added comparison '%s %s'", op, value)
+    }
+    return numberFilter{func(song sublibSong) int64 { return song.Added.Unix() }, op, added.Unix()}, nil
+  }
+  return nil, fmt.Errorf("unknown field '%s'", fieldToken.text)
+}
+
+// Parse a date, or a time before now, such as 30d, 12w, 6m or 1y.
+func parseFilterTime(value string, now time.Time) (time.Time, error) {
+  if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+    return t, nil
+  }
+  if len(value) < 2 {
+    return now, fmt.Errorf("invalid time '%s'", value)
+  }
+  n, err := strconv.Atoi(value[:len(value) - 1])
+  if err != nil {
+    return now, fmt.Errorf("invalid time '%s'", value)
+  }
+  switch value[len(value) - 1] {
+  case 'd':
+    return now.AddDate(0, 0, -n), nil
+  case 'w':
+    return now.AddDate(0, 0, -7 * n), nil
+  case 'm':
+    return now.AddDate(0, -n, 0), nil
+  case 'y':
+    return now.AddDate(-n, 0, 0), nil
+  }
+  return now, fmt.Errorf("invalid time '%s'", value)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+func TestParseSublibFilter(t *testing.T) {
+  now := time.Now()
+  song := sublibSong{
+    Song: &Song{Title: "So What", Extension: ".flac", Duration: "9:22", Flags: "live, favorite", State: 2, Added: now.AddDate(0, 0, -10)},
+    Artist: "Miles Davis",
+    Album: "Kind of Blue",
+  }
+  tests := []struct {
+    expression string
+    want bool
+  }{
+    {`artist = "Miles Davis"`, true},
+    {`artist = 'miles davis'`, true},
+    {`artist != "Miles Davis"`, false},
+    {`album ~ blue`, true},
+    {`title !~ what`, false},
+    {`extension = .flac`, true},
+    {`extension = .mp3`, false},
+    {`flags = live`, true},
+    {`flags = LIVE`, true},
+    {`flags = liv`, false},
+    {`flags ~ liv`, true},
+    {`flags != bootleg`, true},
+    {`duration > 9:00`, true},
+    {`duration < 562`, false},
+    {`duration <= 562`, true},
+    {`duration >= 1:00:00`, false},
+    {`state = 2`, true},
+    {`state != 2`, false},
+    {`added > 30d`, true},
+    {`added > 1w`, false},
+    {`added < 2000-01-01`, false},
+    {`artist = "Miles Davis" and duration < 5:00`, false},
+    {`artist = "Miles Davis" and (duration < 5:00 or flags = live)`, true},
+    {`duration < 5:00 or flags = live and state = 3`, false},
+    {`not flags = live`, false},
+    {`not (state = 1 or state = 3)`, true},
+    {`NOT state = 1 AND extension = .flac`, true},
+  }
+  for _, test := range(tests) {
+    filter, err := parseSublibFilter(test.expression)
+    if err != nil {
+      t.Errorf("%s: %v", test.expression, err)
+      continue
+    }
+    if got := filter.matches(song); got != test.want {
+      t.Errorf("%s: matches = %v, want %v", test.expression, got, test.want)
+    }
+  }
+}
+
+func TestParseSublibFilterErrors(t *testing.T) {
+  tests := []string{
+    ``,
+    `artist`,
+    `artist =`,
+    `artist < x`,
+    `flags > live`,
+    `genre = jazz`,
+    `duration ~ 3:00`,
+    `duration < soon`,
+    `state = two`,
+    `added > yesterday`,
+    `artist = "unterminated`,
+    `(state = 1`,
+    `state = 1)`,
+    `state = 1 state = 2`,
+    `artist "=" x`,
+  }
+  for _, expression := range(tests) {
+    if _, err := parseSublibFilter(expression); err == nil {
+      t.Errorf("%s: no error", expression)
+    }
+  }
+}
+
+func TestParseFilterTime(t *testing.T) {
+  now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.Local)
+  tests := []struct {
+    value string
+    want time.Time
+    wantErr bool
+  }{
+    {"2019-03-01", time.Date(2019, 3, 1, 0, 0, 0, 0, time.Local), false},
+    {"30d", time.Date(2020, 5, 16, 12, 0, 0, 0, time.Local), false},
+    {"2w", time.Date(2020, 6, 1, 12, 0, 0, 0, time.Local), false},
+    {"6m", time.Date(2019, 12, 15, 12, 0, 0, 0, time.Local), false},
+    {"1y", time.Date(2019, 6, 15, 12, 0, 0, 0, time.Local), false},
+    {"d", now, true},
+    {"10x", now, true},
+    {"xd", now, true},
+    {"2019-13-01", now, true},
+  }
+  for _, test := range(tests) {
+    got, err := parseFilterTime(test.value, now)
+    if (err != nil) != test.wantErr {
+      t.Errorf("%s: err = %v, want error %v", test.value, err, test.wantErr)
+      continue
+    }
+    if !got.Equal(test.want) {
+      t.Errorf("%s: got %v, want %v", test.value, got, test.want)
+    }
+  }
+}
+
+func TestSublibFilterMembers(t *testing.T) {
+  songs := []sublibSong{
+    {&Song{Id: 1, Duration: "9:22", Extension: ".flac"}, "Miles Davis", "Kind of Blue"},
+    {&Song{Id: 2, Duration: "3:30", Extension: ".flac"}, "Miles Davis", "Kind of Blue"},
+    {&Song{Id: 3, Duration: "4:00", Extension: ".mp3"}, "Bill Evans", "Waltz for Debby"},
+  }
+  filter, err := parseSublibFilter("duration < 5:00")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // The filter is combined with the other rules.
+  sub := &SublibInfo{Extensions: []string{".flac"}, filter: filter}
+  members, err := findSublibMembers(nil, sub, songs)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(members) != 1 || !members[2] {
+    t.Errorf("got %v, want song 2", members)
+  }
+}
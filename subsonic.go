@@ -0,0 +1,339 @@
+package main
+
+import (
+  "crypto/md5"
+  "crypto/subtle"
+  "database/sql"
+  "encoding/hex"
+  "encoding/xml"
+  "net/http"
+  "strconv"
+  "strings"
+  "github.com/labstack/echo/v4"
+)
+
+// A subset of the Subsonic API (http://www.subsonic.org/pages/api.jsp), so
+// that Subsonic and OpenSubsonic clients can browse and play the library.
+// Artists, albums and songs are identified by their ids in the database.
+
+const subsonicApiVersion = "1.16.1"
+
+// Error codes defined by the Subsonic API.
+const subsonicGenericError = 0
+const subsonicMissingParameter = 10
+const subsonicWrongCredentials = 40
+const subsonicNotFound = 70
+
+type subsonicResponse struct {
+  XMLName xml.Name `xml:"http://subsonic.org/restapi subsonic-response" json:"-"`
+  Status string `xml:"status,attr" json:"status"`
+  Version string `xml:"version,attr" json:"version"`
+  Type string `xml:"type,attr" json:"type"`
+  OpenSubsonic bool `xml:"openSubsonic,attr" json:"openSubsonic"`
+  Error *subsonicError `xml:"error,omitempty" json:"error,omitempty"`
+  License *subsonicLicense `xml:"license,omitempty" json:"license,omitempty"`
+  MusicFolders *subsonicMusicFolders `xml:"musicFolders,omitempty" json:"musicFolders,omitempty"`
+  Artists *subsonicArtists `xml:"artists,omitempty" json:"artists,omitempty"`
+  Artist *subsonicArtist `xml:"artist,omitempty" json:"artist,omitempty"`
+  Album *subsonicAlbum `xml:"album,omitempty" json:"album,omitempty"`
+  Song *subsonicSong `xml:"song,omitempty" json:"song,omitempty"`
+  SearchResult3 *subsonicSearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+}
+
+type subsonicError struct {
+  Code int `xml:"code,attr" json:"code"`
+  Message string `xml:"message,attr" json:"message"`
+}
+
+type subsonicLicense struct {
+  Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type subsonicMusicFolders struct {
+  MusicFolders []subsonicMusicFolder `xml:"musicFolder" json:"musicFolder"`
+}
+
+type subsonicMusicFolder struct {
+  Id int `xml:"id,attr" json:"id"`
+  Name string `xml:"name,attr" json:"name"`
+}
+
+type subsonicArtists struct {
+  IgnoredArticles string `xml:"ignoredArticles,attr" json:"ignoredArticles"`
+  Indexes []subsonicIndex `xml:"index" json:"index"`
+}
+
+type subsonicIndex struct {
+  Name string `xml:"name,attr" json:"name"`
+  Artists []subsonicArtist `xml:"artist" json:"artist"`
+}
+
+type subsonicArtist struct {
+  Id string `xml:"id,attr" json:"id"`
+  Name string `xml:"name,attr" json:"name"`
+  AlbumCount int `xml:"albumCount,attr" json:"albumCount"`
+  Albums []subsonicAlbum `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type subsonicAlbum struct {
+  Id string `xml:"id,attr" json:"id"`
+  Name string `xml:"name,attr" json:"name"`
+  Artist string `xml:"artist,attr" json:"artist"`
+  ArtistId string `xml:"artistId,attr" json:"artistId"`
+  CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+  SongCount int `xml:"songCount,attr" json:"songCount"`
+  Duration int `xml:"duration,attr" json:"duration"`
+  Songs []subsonicSong `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+type subsonicSong struct {
+  Id string `xml:"id,attr" json:"id"`
+  Parent string `xml:"parent,attr" json:"parent"`
+  IsDir bool `xml:"isDir,attr" json:"isDir"`
+  Title string `xml:"title,attr" json:"title"`
+  Album string `xml:"album,attr" json:"album"`
+  Artist string `xml:"artist,attr" json:"artist"`
+  Track int `xml:"track,attr" json:"track"`
+  DiscNumber int `xml:"discNumber,attr" json:"discNumber"`
+  CoverArt string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+  Size int64 `xml:"size,attr" json:"size"`
+  ContentType string `xml:"contentType,attr" json:"contentType"`
+  Suffix string `xml:"suffix,attr" json:"suffix"`
+  Duration int `xml:"duration,attr" json:"duration"`
+  Path string `xml:"path,attr" json:"path"`
+  AlbumId string `xml:"albumId,attr" json:"albumId"`
+  ArtistId string `xml:"artistId,attr" json:"artistId"`
+  Type string `xml:"type,attr" json:"type"`
+}
+
+type subsonicSearchResult3 struct {
+  Artists []subsonicArtist `xml:"artist" json:"artist"`
+  Albums []subsonicAlbum `xml:"album" json:"album"`
+  Songs []subsonicSong `xml:"song" json:"song"`
+}
+
+type subsonicHandler func(e *echo.Echo, c echo.Context, db *sql.DB) error
+
+func addSubsonicRoutes(e *echo.Echo, db *sql.DB) {
+  rest := e.Group("/rest", subsonicAuth)
+  handlers := map[string]subsonicHandler {
+    "ping": subsonicPing,
+    "getLicense": subsonicGetLicense,
+    "getMusicFolders": subsonicGetMusicFolders,
+    "getArtists": subsonicGetArtists,
+    "getArtist": subsonicGetArtist,
+    "getAlbum": subsonicGetAlbum,
+    "getSong": subsonicGetSong,
+    "stream": subsonicStream,
+    "search3": subsonicSearch3,
+    "getCoverArt": subsonicGetCoverArt,
+  }
+  for name, handler := range(handlers) {
+    h := handler
+    f := func(c echo.Context) error {
+      return h(e, c, db)
+    }
+    // Clients may add .view to the name, and may send parameters in a form.
+    methods := []string{http.MethodGet, http.MethodPost}
+    rest.Match(methods, "/" + name, f)
+    rest.Match(methods, "/" + name + ".view", f)
+  }
+}
+
+// Check the credentials in the request against the configured users.  Clients
+// either send the password (possibly hex encoded), or a token that is the md5
+// of the password followed by a salt.
+func subsonicAuth(next echo.HandlerFunc) echo.HandlerFunc {
+  return func(c echo.Context) error {
+    name := c.FormValue("u")
+    if name == "" {
+      return sendSubsonicError(c, subsonicMissingParameter, "Required parameter is missing: u")
+    }
+    var password string
+    found := false
+    for _, user := range(config.Subsonic.Users) {
+      if user.Name == name {
+        password = user.Password
+        found = true
+        break
+      }
+    }
+    var expected, actual string
+    if token, salt := c.FormValue("t"), c.FormValue("s"); token != "" && salt != "" {
+      sum := md5.Sum([]byte(password + salt))
+      expected = hex.EncodeToString(sum[:])
+      actual = strings.ToLower(token)
+    } else if p := c.FormValue("p"); p != "" {
+      expected = password
+      actual = p
+      if strings.HasPrefix(p, "enc:") {
+        decoded, err := hex.DecodeString(p[4:])
+        if err != nil {
+          return sendSubsonicError(c, subsonicWrongCredentials, "Wrong username or password")
+        }
+        actual = string(decoded)
+      }
+    } else {
+      return sendSubsonicError(c, subsonicMissingParameter, "Required parameter is missing: t and s, or p")
+    }
+    if !found || subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) != 1 {
+      return sendSubsonicError(c, subsonicWrongCredentials, "Wrong username or password")
+    }
+    return next(c)
+  }
+}
+
+// Send a response in the format the client asked for.  Subsonic responses,
+// including errors, always have a status of 200.
+func sendSubsonic(c echo.Context, resp *subsonicResponse) error {
+  resp.Status = "ok"
+  if resp.Error != nil {
+    resp.Status = "failed"
+  }
+  resp.Version = subsonicApiVersion
+  resp.Type = "musiclib"
+  resp.OpenSubsonic = true
+  if c.FormValue("f") == "json" {
+    return c.JSON(http.StatusOK, map[string]*subsonicResponse{"subsonic-response": resp})
+  }
+  return c.XML(http.StatusOK, resp)
+}
+
+func sendSubsonicError(c echo.Context, code int, message string) error {
+  return sendSubsonic(c, &subsonicResponse{Error: &subsonicError{code, message}})
+}
+
+// Get the id parameter, returning false if it is missing or invalid.
+func subsonicId(c echo.Context) (int, bool) {
+  id, err := strconv.Atoi(c.FormValue("id"))
+  return id, err == nil
+}
+
+func sendSubsonicBadId(c echo.Context) error {
+  return sendSubsonicError(c, subsonicMissingParameter, "Required parameter is missing or invalid: id")
+}
+
+// Get an optional numeric parameter.
+func subsonicIntParam(c echo.Context, param string, defaultValue int) int {
+  n, err := strconv.Atoi(c.FormValue(param))
+  if err != nil || n < 0 {
+    return defaultValue
+  }
+  return n
+}
+
+// Send an error for a failed database call.
+func sendSubsonicDbError(e *echo.Echo, c echo.Context, what string, err error) error {
+  if err == sql.ErrNoRows {
+    return sendSubsonicError(c, subsonicNotFound, what + " not found")
+  }
+  e.Logger.Errorf("Error loading %s: %s\n", what, err.Error())
+  return sendSubsonicError(c, subsonicGenericError, "Error loading " + what)
+}
+
+func subsonicPing(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  return sendSubsonic(c, &subsonicResponse{})
+}
+
+func subsonicGetLicense(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  return sendSubsonic(c, &subsonicResponse{License: &subsonicLicense{true}})
+}
+
+// Each of the selected libraries is a music folder.
+func subsonicGetMusicFolders(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  folders := &subsonicMusicFolders{make([]subsonicMusicFolder, 0, len(selectedLibraries))}
+  for i, lib := range(selectedLibraries) {
+    folders.MusicFolders = append(folders.MusicFolders, subsonicMusicFolder{i + 1, lib.Name})
+  }
+  return sendSubsonic(c, &subsonicResponse{MusicFolders: folders})
+}
+
+func subsonicGetArtists(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  indexes, err := loadSubsonicIndexes(db)
+  if err != nil {
+    return sendSubsonicDbError(e, c, "artists", err)
+  }
+  return sendSubsonic(c, &subsonicResponse{Artists: &subsonicArtists{"The An A", indexes}})
+}
+
+func subsonicGetArtist(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  id, ok := subsonicId(c)
+  if !ok {
+    return sendSubsonicBadId(c)
+  }
+  artist, err := loadSubsonicArtist(db, id)
+  if err != nil {
+    return sendSubsonicDbError(e, c, "artist", err)
+  }
+  return sendSubsonic(c, &subsonicResponse{Artist: &artist})
+}
+
+func subsonicGetAlbum(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  id, ok := subsonicId(c)
+  if !ok {
+    return sendSubsonicBadId(c)
+  }
+  album, err := loadSubsonicAlbum(db, id)
+  if err != nil {
+    return sendSubsonicDbError(e, c, "album", err)
+  }
+  return sendSubsonic(c, &subsonicResponse{Album: &album})
+}
+
+func subsonicGetSong(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  id, ok := subsonicId(c)
+  if !ok {
+    return sendSubsonicBadId(c)
+  }
+  song, err := loadSubsonicSong(db, id)
+  if err != nil {
+    return sendSubsonicDbError(e, c, "song", err)
+  }
+  return sendSubsonic(c, &subsonicResponse{Song: &song})
+}
+
+// Send the original file, unless the client asked for a format we have a
+// transcoder for.
+func subsonicStream(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  id, ok := subsonicId(c)
+  if !ok {
+    return sendSubsonicBadId(c)
+  }
+  if format := c.FormValue("format"); format != "" && format != "raw" {
+    if encoder := findTranscoder(format); encoder != nil {
+      bitrate := subsonicIntParam(c, "maxBitRate", 0)
+      if bitrate == 0 {
+        bitrate = config.Transcode.DefaultBitrate
+      }
+      if bitrate < minTranscodeBitrate {
+        bitrate = minTranscodeBitrate
+      } else if bitrate > maxTranscodeBitrate {
+        bitrate = maxTranscodeBitrate
+      }
+      return sendTranscodedSong(e, c, db, id, encoder, bitrate)
+    }
+  }
+  return sendSongFile(e, c, db, id, "")
+}
+
+func subsonicSearch3(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  // Some clients send a query of "" to get everything.
+  query := strings.Trim(c.FormValue("query"), `"`)
+  result, err := searchSubsonic(db, query,
+    subsonicIntParam(c, "artistCount", 20), subsonicIntParam(c, "artistOffset", 0),
+    subsonicIntParam(c, "albumCount", 20), subsonicIntParam(c, "albumOffset", 0),
+    subsonicIntParam(c, "songCount", 20), subsonicIntParam(c, "songOffset", 0))
+  if err != nil {
+    return sendSubsonicDbError(e, c, "search results", err)
+  }
+  return sendSubsonic(c, &subsonicResponse{SearchResult3: &result})
+}
+
+// The cover art id of an album, or of a song, is the id of the album.
+func subsonicGetCoverArt(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  id, ok := subsonicId(c)
+  if !ok {
+    return sendSubsonicBadId(c)
+  }
+  return sendAlbumCover(e, c, db, id, c.FormValue("size"))
+}
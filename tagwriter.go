@@ -0,0 +1,247 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "github.com/bogem/id3v2/v2"
+  "github.com/go-flac/flacpicture"
+  "github.com/go-flac/flacvorbis"
+  "github.com/go-flac/go-flac"
+)
+
+// The tags of a song, as they are in the database.  The commands of an
+// encoder can use them with $TITLE, $ARTIST, $ALBUMARTIST, $ALBUM, $TRACK and
+// $DISC, and an encoder with tags set writes them into its outputs, along
+// with the album's art, so that the outputs are tagged the same way whatever
+// the encoding program does with tags.  There is no separate artist for a
+// song, so $ARTIST and $ALBUMARTIST are both the artist of the album.  The
+// gains and peaks are nil if the loudness command hasn't analyzed the song
+// (or all of the songs of its album) since the song last changed.
+type songTags struct {
+  Title string
+  Artist string
+  Album string
+  Track int
+  Disc int
+  CoverHash string
+  TrackGain *float64
+  TrackPeak *float64
+  AlbumGain *float64
+  AlbumPeak *float64
+}
+
+type tagField struct {
+  name string
+  value string
+}
+
+// The extensions of the files tags can be written to.
+var taggableExtensions = []string{".mp3", ".flac"}
+
+// Returns a replacer for the tag placeholders in an encoder's commands.
+// $ALBUMARTIST comes before $ALBUM and $ARTIST, so it isn't taken for
+// either of them.
+func tagReplacer(t songTags) *strings.Replacer {
+  return strings.NewReplacer(
+    "$ALBUMARTIST", t.Artist,
+    "$TITLE", t.Title,
+    "$ARTIST", t.Artist,
+    "$ALBUM", t.Album,
+    "$TRACK", tagNumber(t.Track),
+    "$DISC", tagNumber(t.Disc),
+  )
+}
+
+// Returns a track or disc number for a placeholder.  A song without a number
+// has 0 in the database, which is replaced with nothing, so that encoders
+// don't write a number of 0.
+func tagNumber(n int) string {
+  if n <= 0 {
+    return ""
+  }
+  return strconv.Itoa(n)
+}
+
+// Write tags into a file.  If canonical is true, the tags that are already
+// there are replaced with the song's tags and the album art, if there is any.
+// If gain is true, the ReplayGain tags are replaced with the song's gains and
+// peaks, and the file's other tags are left alone unless canonical is true.
+func writeTags(filePath string, t songTags, canonical, gain bool) error {
+  var cover []byte
+  if canonical {
+    var err error
+    if cover, err = readCover(t.CoverHash); err != nil {
+      return err
+    }
+  }
+  var gainFields []tagField
+  if gain {
+    gainFields = gainTagFields(t)
+    // Without anything to write, a file whose other tags are to be left
+    // alone isn't touched.
+    if len(gainFields) == 0 && !canonical {
+      return nil
+    }
+  }
+  switch strings.ToLower(filepath.Ext(filePath)) {
+  case ".mp3":
+    return writeId3Tags(filePath, t, cover, canonical, gainFields)
+  case ".flac":
+    return writeFlacTags(filePath, t, cover, canonical, gainFields)
+  }
+  return fmt.Errorf("can't write tags to %s", filePath)
+}
+
+// Returns the ReplayGain tags for the gains and peaks the song has.
+func gainTagFields(t songTags) []tagField {
+  fields := make([]tagField, 0, 4)
+  if t.TrackGain != nil && t.TrackPeak != nil {
+    fields = append(fields, tagField{"REPLAYGAIN_TRACK_GAIN", fmt.Sprintf("%.2f dB", *t.TrackGain)})
+    fields = append(fields, tagField{"REPLAYGAIN_TRACK_PEAK", fmt.Sprintf("%.6f", *t.TrackPeak)})
+  }
+  if t.AlbumGain != nil && t.AlbumPeak != nil {
+    fields = append(fields, tagField{"REPLAYGAIN_ALBUM_GAIN", fmt.Sprintf("%.2f dB", *t.AlbumGain)})
+    fields = append(fields, tagField{"REPLAYGAIN_ALBUM_PEAK", fmt.Sprintf("%.6f", *t.AlbumPeak)})
+  }
+  return fields
+}
+
+func isGainTag(name string) bool {
+  return strings.HasPrefix(strings.ToUpper(name), "REPLAYGAIN_")
+}
+
+// Returns the original image of the cover with the given hash, or nil if
+// there isn't one.
+func readCover(hash string) ([]byte, error) {
+  if hash == "" || config.ArtDir == "" {
+    return nil, nil
+  }
+  data, err := os.ReadFile(filepath.Join(config.ArtDir, hash))
+  if os.IsNotExist(err) {
+    return nil, nil
+  }
+  return data, err
+}
+
+func writeId3Tags(filePath string, t songTags, cover []byte, canonical bool, gainFields []tagField) error {
+  tag, err := id3v2.Open(filePath, id3v2.Options{Parse: !canonical})
+  if err != nil {
+    return err
+  }
+  defer tag.Close()
+  if canonical {
+    setId3Tags(tag, t, cover)
+  } else {
+    // Keep the user defined frames that aren't ReplayGain tags.
+    id := tag.CommonID("User defined text information frame")
+    frames := tag.GetFrames(id)
+    tag.DeleteFrames(id)
+    for _, frame := range(frames) {
+      if udtf, ok := frame.(id3v2.UserDefinedTextFrame); ok && !isGainTag(udtf.Description) {
+        tag.AddUserDefinedTextFrame(udtf)
+      }
+    }
+  }
+  for _, field := range(gainFields) {
+    tag.AddUserDefinedTextFrame(id3v2.UserDefinedTextFrame{
+      Encoding: tag.DefaultEncoding(),
+      Description: field.name,
+      Value: field.value,
+    })
+  }
+  return tag.Save()
+}
+
+func setId3Tags(tag *id3v2.Tag, t songTags, cover []byte) {
+  tag.DeleteAllFrames()
+  tag.SetVersion(4)
+  tag.SetDefaultEncoding(id3v2.EncodingUTF8)
+  tag.SetTitle(t.Title)
+  tag.SetArtist(t.Artist)
+  tag.SetAlbum(t.Album)
+  tag.AddTextFrame(tag.CommonID("Band/Orchestra/Accompaniment"), id3v2.EncodingUTF8, t.Artist)
+  if t.Track > 0 {
+    tag.AddTextFrame(tag.CommonID("Track number/Position in set"), id3v2.EncodingUTF8, strconv.Itoa(t.Track))
+  }
+  if t.Disc > 0 {
+    tag.AddTextFrame(tag.CommonID("Part of a set"), id3v2.EncodingUTF8, strconv.Itoa(t.Disc))
+  }
+  if cover != nil {
+    tag.AddAttachedPicture(id3v2.PictureFrame{
+      Encoding: id3v2.EncodingUTF8,
+      MimeType: http.DetectContentType(cover),
+      PictureType: id3v2.PTFrontCover,
+      Picture: cover,
+    })
+  }
+}
+
+func writeFlacTags(filePath string, t songTags, cover []byte, canonical bool, gainFields []tagField) error {
+  file, err := flac.ParseFile(filePath)
+  if err != nil {
+    return err
+  }
+  comment := flacvorbis.New()
+  if !canonical {
+    // Keep the comments that are already there, other than the ReplayGain
+    // tags.
+    for _, block := range(file.Meta) {
+      if block.Type != flac.VorbisComment {
+        continue
+      }
+      existing, err := flacvorbis.ParseFromMetaDataBlock(*block)
+      if err != nil {
+        return err
+      }
+      comment.Vendor = existing.Vendor
+      for _, field := range(existing.Comments) {
+        if !isGainTag(strings.SplitN(field, "=", 2)[0]) {
+          comment.Comments = append(comment.Comments, field)
+        }
+      }
+    }
+  } else {
+    setVorbisComments(comment, t)
+  }
+  for _, field := range(gainFields) {
+    comment.Add(field.name, field.value)
+  }
+  // Keep the blocks other than the comments, and the pictures if the tags
+  // aren't canonical.  The stream info block has to stay first.
+  meta := make([]*flac.MetaDataBlock, 0, len(file.Meta) + 2)
+  for _, block := range(file.Meta) {
+    if block.Type != flac.VorbisComment && (block.Type != flac.Picture || !canonical) {
+      meta = append(meta, block)
+    }
+  }
+  commentBlock := comment.Marshal()
+  meta = append(meta, &commentBlock)
+  if cover != nil {
+    picture, err := flacpicture.NewFromImageData(flacpicture.PictureTypeFrontCover, "", cover, http.DetectContentType(cover))
+    if err != nil {
+      return err
+    }
+    pictureBlock := picture.Marshal()
+    meta = append(meta, &pictureBlock)
+  }
+  file.Meta = meta
+  return file.Save(filePath)
+}
+
+func setVorbisComments(comment *flacvorbis.MetaDataBlockVorbisComment, t songTags) {
+  comment.Add(flacvorbis.FIELD_TITLE, t.Title)
+  comment.Add(flacvorbis.FIELD_ARTIST, t.Artist)
+  comment.Add("ALBUMARTIST", t.Artist)
+  comment.Add(flacvorbis.FIELD_ALBUM, t.Album)
+  if t.Track > 0 {
+    comment.Add(flacvorbis.FIELD_TRACKNUMBER, strconv.Itoa(t.Track))
+  }
+  if t.Disc > 0 {
+    comment.Add("DISCNUMBER", strconv.Itoa(t.Disc))
+  }
+}
+
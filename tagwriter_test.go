@@ -0,0 +1,75 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestTagReplacer(t *testing.T) {
+  song := songTags{Title: "Blue in Green", Artist: "Miles Davis", Album: "Kind of Blue", Track: 3, Disc: 1}
+  tests := []struct {
+    song songTags
+    arg string
+    want string
+  }{
+    {song, "$TITLE", "Blue in Green"},
+    {song, "$ARTIST", "Miles Davis"},
+    {song, "$ALBUMARTIST", "Miles Davis"},
+    {song, "$ALBUM", "Kind of Blue"},
+    {song, "--tn=$TRACK/$DISC", "--tn=3/1"},
+    {song, "$ARTIST - $ALBUM", "Miles Davis - Kind of Blue"},
+    {song, "$INPUT", "$INPUT"},
+    {song, "plain", "plain"},
+    // A song without a track or disc number has 0 for it.
+    {songTags{Title: "Untitled"}, "--tn=$TRACK", "--tn="},
+    {songTags{Title: "Untitled", Track: 7}, "$TRACK/$DISC", "7/"},
+  }
+  for _, test := range(tests) {
+    if got := tagReplacer(test.song).Replace(test.arg); got != test.want {
+      t.Errorf("Replace(%q) = %q, want %q", test.arg, got, test.want)
+    }
+  }
+}
+
+func TestWriteTagsUnknownExtension(t *testing.T) {
+  if err := writeTags("song.ogg", songTags{Title: "Song"}, true, false); err == nil {
+    t.Errorf("wrote tags to an ogg file")
+  }
+}
+
+func TestGainTagFields(t *testing.T) {
+  tests := []struct {
+    name string
+    song songTags
+    want []tagField
+  }{
+    {"none", songTags{}, []tagField{}},
+    {"track", songTags{TrackGain: floatPtr(-3.456), TrackPeak: floatPtr(0.98765432)}, []tagField{
+      {"REPLAYGAIN_TRACK_GAIN", "-3.46 dB"},
+      {"REPLAYGAIN_TRACK_PEAK", "0.987654"},
+    }},
+    {"track and album", songTags{TrackGain: floatPtr(2), TrackPeak: floatPtr(0.5), AlbumGain: floatPtr(-1.5), AlbumPeak: floatPtr(1)}, []tagField{
+      {"REPLAYGAIN_TRACK_GAIN", "2.00 dB"},
+      {"REPLAYGAIN_TRACK_PEAK", "0.500000"},
+      {"REPLAYGAIN_ALBUM_GAIN", "-1.50 dB"},
+      {"REPLAYGAIN_ALBUM_PEAK", "1.000000"},
+    }},
+    {"gain without peak", songTags{TrackGain: floatPtr(2), AlbumGain: floatPtr(1), AlbumPeak: floatPtr(0.5)}, []tagField{
+      {"REPLAYGAIN_ALBUM_GAIN", "1.00 dB"},
+      {"REPLAYGAIN_ALBUM_PEAK", "0.500000"},
+    }},
+  }
+  for _, test := range(tests) {
+    if got := gainTagFields(test.song); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestIsGainTag(t *testing.T) {
+  for name, want := range(map[string]bool{"REPLAYGAIN_TRACK_GAIN": true, "replaygain_album_peak": true, "TITLE": false, "": false}) {
+    if got := isGainTag(name); got != want {
+      t.Errorf("isGainTag(%q) = %v, want %v", name, got, want)
+    }
+  }
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "os"
+  "path"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "github.com/labstack/echo/v4"
+)
+
+const defaultMaxTranscodes = 2
+const defaultTranscodeBitrate = 192
+const minTranscodeBitrate = 32
+const maxTranscodeBitrate = 320
+
+// Limits the number of transcodes that run at once.  Each running transcode
+// holds a slot in the channel.
+var transcodeSlots chan struct{}
+
+// Check the transcoding encoders and set the defaults.
+func validateTranscoders() {
+  if config.Transcode.MaxConcurrent <= 0 {
+    config.Transcode.MaxConcurrent = defaultMaxTranscodes
+  }
+  if config.Transcode.DefaultBitrate <= 0 {
+    config.Transcode.DefaultBitrate = defaultTranscodeBitrate
+  }
+  for i, encoder := range(config.Transcode.Encoders) {
+    if encoder.Extension == "" {
+      log.Fatalf("Transcoder %v does not have an extension\n", encoder)
+    }
+    setEncoderBackend(&config.Transcode.Encoders[i])
+  }
+  if config.Transcode.CacheDir != "" {
+    if err := os.MkdirAll(config.Transcode.CacheDir, 0775); err != nil {
+      log.Fatalf("Can't create transcode cache directory '%s': %s\n", config.Transcode.CacheDir, err.Error())
+    }
+  }
+  transcodeSlots = make(chan struct{}, config.Transcode.MaxConcurrent)
+}
+
+func findTranscoder(format string) *EncoderInfo {
+  for i := range(config.Transcode.Encoders) {
+    if config.Transcode.Encoders[i].Extension == format {
+      return &config.Transcode.Encoders[i]
+    }
+  }
+  return nil
+}
+
+func transcodeSong(e *echo.Echo, c echo.Context, db *sql.DB) error {
+  songString := c.Param("songId")
+  songId, err := strconv.Atoi(songString)
+  if err != nil {
+    e.Logger.Errorf("Can't convert songId '%s' to a number\n", songString)
+    return c.String(http.StatusBadRequest, "Can't convert songId to a number\n")
+  }
+  format := c.QueryParam("format")
+  encoder := findTranscoder(format)
+  if encoder == nil {
+    return c.String(http.StatusBadRequest, fmt.Sprintf("Can't transcode to '%s'\n", format))
+  }
+  bitrate := config.Transcode.DefaultBitrate
+  if bitrateString := c.QueryParam("bitrate"); bitrateString != "" {
+    bitrate, err = strconv.Atoi(bitrateString)
+    if err != nil || bitrate < minTranscodeBitrate || bitrate > maxTranscodeBitrate {
+      e.Logger.Errorf("Invalid bitrate '%s'\n", bitrateString)
+      return c.String(http.StatusBadRequest, fmt.Sprintf("Bitrate must be a number from %d to %d\n", minTranscodeBitrate, maxTranscodeBitrate))
+    }
+  }
+  return sendTranscodedSong(e, c, db, songId, encoder, bitrate)
+}
+
+// Transcode a song with the encoder and send the result as it is produced.
+// If there is a cache directory, the result is also saved there, and later
+// requests for the same song, format and bitrate are served from the cache.
+func sendTranscodedSong(e *echo.Echo, c echo.Context, db *sql.DB, songId int, encoder *EncoderInfo, bitrate int) error {
+  format := encoder.Extension
+  song, libraryName, err := loadSongWithLibrary(db, songId)
+  if err == sql.ErrNoRows {
+    return c.String(http.StatusNotFound, "No such song\n")
+  }
+  if err != nil {
+    e.Logger.Errorf("Error loading song %d: %s\n", songId, err.Error())
+    return c.String(http.StatusInternalServerError, "Error loading song\n")
+  }
+  lib := findSelectedLibrary(libraryName)
+  if lib == nil {
+    return c.String(http.StatusNotFound, "No such song\n")
+  }
+  inputPath := path.Join(lib.MusicDir, song.RelativePath)
+  mimeType := mimeTypeForExtension(format)
+
+  var cachePath string
+  if config.Transcode.CacheDir != "" {
+    cachePath = filepath.Join(config.Transcode.CacheDir,
+      fmt.Sprintf("%d-%s-%d.%s", song.Id, song.SizeAndTime, bitrate, strings.TrimPrefix(format, ".")))
+    if file, err := os.Open(cachePath); err == nil {
+      defer file.Close()
+      if info, err := file.Stat(); err == nil {
+        c.Response().Header().Set(echo.HeaderContentType, mimeType)
+        http.ServeContent(c.Response(), c.Request(), path.Base(cachePath), info.ModTime(), file)
+        return nil
+      }
+    }
+  }
+
+  // Wait for a free slot, unless the client gives up first.
+  ctx := c.Request().Context()
+  select {
+  case transcodeSlots <- struct{}{}:
+    defer func() { <-transcodeSlots }()
+  case <-ctx.Done():
+    return ctx.Err()
+  }
+
+  var output io.Writer = c.Response()
+  var cacheFile *os.File
+  if cachePath != "" {
+    // Write to a temporary file, which is only moved into place if the
+    // transcode succeeds, so the cache never holds a partial file.
+    cacheFile, err = os.CreateTemp(config.Transcode.CacheDir, "transcode-*")
+    if err != nil {
+      e.Logger.Errorf("Can't create transcode cache file: %s\n", err.Error())
+    } else {
+      defer os.Remove(cacheFile.Name())
+      defer cacheFile.Close()
+      output = io.MultiWriter(c.Response(), cacheFile)
+    }
+  }
+
+  // The status is sent with the first of the output, so it can still be an
+  // error if the encoder fails before writing anything.  The encoder is
+  // stopped if the client disconnects.
+  c.Response().Header().Set(echo.HeaderContentType, mimeType)
+  var stderr strings.Builder
+  err = encoder.backend.Encode(ctx, encodeRequest{InputPath: inputPath, Output: output, Stderr: &stderr, Bitrate: bitrate})
+  if err != nil {
+    e.Logger.Errorf("Error transcoding song %d: %s %s\n", songId, err.Error(), stderr.String())
+    if !c.Response().Committed {
+      return c.String(http.StatusInternalServerError, "Error transcoding song\n")
+    }
+    // The status has already been sent, so all we can do is log the error.
+    return nil
+  }
+  if cacheFile != nil {
+    if err := cacheFile.Close(); err == nil {
+      if err := os.Rename(cacheFile.Name(), cachePath); err != nil {
+        e.Logger.Errorf("Can't save '%s' in transcode cache: %s\n", cachePath, err.Error())
+      }
+    }
+  }
+  return nil
+}